@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// ExportRoom streams the room archive (see db.ExportRoom), mounted behind
+// RequireRoomRole so only room owners get here
+func ExportRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		archive, err := db.ExportRoom(roomID)
+		if err != nil {
+			fmt.Printf("Error exporting room: %v\n", err)
+			http.Error(w, "export failed", http.StatusInternalServerError)
+			return
+		}
+		if archive == nil {
+			http.Error(w, "room not exist", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "room-"+roomID+".json"))
+		_ = json.NewEncoder(w).Encode(archive)
+	}
+}
+
+type CloneRoomReq struct {
+	SourceRoomID string  `json:"sourceRoomId"`
+	RoomID       string  `json:"roomId"`
+	Layers       []int64 `json:"layers,omitempty"` // empty copies all
+	KeepMembers  bool    `json:"keepMembers"`
+}
+
+// ImportRoom creates ?roomId= from an archive in the body, the caller
+// becomes owner. ?layers=0,2 copies only those layers, ?keepMembers=1 keeps
+// the archived members. Members and uploaded objects are only taken over
+// when the caller owns the archived room, otherwise its doms come without
+// objects and the caller is the only member.
+func ImportRoom(client *s3.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		layers, err := ParseLayers(r.URL.Query().Get("layers"))
+		if err != nil {
+			http.Error(w, "invalid layers", http.StatusBadRequest)
+			return
+		}
+
+		var archive config.RoomArchive
+		if err := json.NewDecoder(r.Body).Decode(&archive); err != nil {
+			http.Error(w, "invalid archive", http.StatusBadRequest)
+			return
+		}
+
+		// the archive names its source room, its objects and members are
+		// only taken over by an owner of that room, the one who could have
+		// exported it. Anyone else could hand out any role in the archive.
+		access, err := db.GetRoomAccess(archive.Room.RoomID, userID)
+		if err != nil {
+			http.Error(w, "cannot get room role", http.StatusInternalServerError)
+			return
+		}
+		role, ok := access.Role()
+		sourceOwner := ok && role >= config.RoleOwner
+
+		importRoom(r.Context(), w, client, func(opts db.ImportOptions) (map[string]string, error) {
+			keys, err := db.ImportRoom(&archive, opts)
+			if !sourceOwner {
+				keys = nil
+			}
+			return keys, err
+		}, db.ImportOptions{
+			RoomID:      r.URL.Query().Get("roomId"),
+			OwnerID:     userID,
+			Layers:      layers,
+			KeepMembers: sourceOwner && r.URL.Query().Get("keepMembers") == "1",
+		})
+	}
+}
+
+// CloneRoom copies a room the caller can view into a new one they own.
+// Owners copy the whole room, anyone else only the layers they can use and
+// never the members.
+func CloneRoom(client *s3.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Use POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req CloneRoomReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		// the body roomId is the new room, so the source is checked here
+		// rather than by RequireRoomRole
+		access, err := db.GetRoomAccess(req.SourceRoomID, userID)
+		if err != nil {
+			http.Error(w, "cannot get room role", http.StatusInternalServerError)
+			return
+		}
+		if !access.Exists {
+			http.Error(w, "room not exist", http.StatusNotFound)
+			return
+		}
+		role, ok := access.Role()
+		if !ok {
+			http.Error(w, "no perm", http.StatusForbidden)
+			return
+		}
+
+		var layers []int64
+		if len(req.Layers) > 0 {
+			layers = req.Layers
+		}
+		if role < config.RoleOwner {
+			layers, err = usableLayers(req.SourceRoomID, userID, layers)
+			if err != nil {
+				http.Error(w, "cannot check layer", http.StatusInternalServerError)
+				return
+			}
+			if len(layers) == 0 {
+				http.Error(w, "no perm", http.StatusForbidden)
+				return
+			}
+			req.KeepMembers = false
+		}
+
+		importRoom(r.Context(), w, client, func(opts db.ImportOptions) (map[string]string, error) {
+			return db.CloneRoom(req.SourceRoomID, opts)
+		}, db.ImportOptions{
+			RoomID:      req.RoomID,
+			OwnerID:     userID,
+			Layers:      layers,
+			KeepMembers: req.KeepMembers,
+		})
+	}
+}
+
+// usableLayers is want (every layer when nil) cut down to the layers
+// userID passes CheckCanUseLayer for
+func usableLayers(roomID, userID string, want []int64) ([]int64, error) {
+	if want == nil {
+		all, err := db.GetRoomLayers(roomID)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range all {
+			want = append(want, l.Index)
+		}
+	}
+
+	layers := []int64{}
+	for _, l := range want {
+		canUse, err := db.CheckCanUseLayer(roomID, l, userID)
+		if err != nil {
+			return nil, err
+		}
+		if canUse {
+			layers = append(layers, l)
+		}
+	}
+	return layers, nil
+}
+
+func importRoom(ctx context.Context, w http.ResponseWriter, client *s3.Client, run func(db.ImportOptions) (map[string]string, error), opts db.ImportOptions) {
+	if opts.RoomID == "" {
+		http.Error(w, "roomId required", http.StatusBadRequest)
+		return
+	}
+
+	keys, err := run(opts)
+	if errors.Is(err, db.ErrRoomExists) {
+		http.Error(w, "room already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error importing room: %v\n", err)
+		http.Error(w, "import failed", http.StatusInternalServerError)
+		return
+	}
+
+	copied := CopyObjects(ctx, client, keys)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"roomId":  opts.RoomID,
+		"objects": copied,
+	})
+}
+
+// CopyObjects copies every old -> new key in the upload bucket (metadata
+// included) and returns how many made it. A missing source only loses that
+// image, so failures are logged and skipped.
+func CopyObjects(ctx context.Context, client *s3.Client, keys map[string]string) int {
+	bucket := os.Getenv("R2_BUCKET")
+
+	olds := make([]string, 0, len(keys))
+	for old := range keys {
+		olds = append(olds, old)
+	}
+	sort.Strings(olds)
+
+	copied := 0
+	for _, old := range olds {
+		_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(bucket),
+			CopySource: aws.String(bucket + "/" + old),
+			Key:        aws.String(keys[old]),
+		})
+		if err != nil {
+			fmt.Printf("Error copying object %s: %v\n", old, err)
+			continue
+		}
+		copied++
+	}
+	return copied
+}
+
+// ParseLayers reads "0,2,3", empty means all layers (nil)
+func ParseLayers(s string) ([]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var layers []int64
+	for _, part := range strings.Split(s, ",") {
+		l, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
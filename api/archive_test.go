@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+func TestCloneRoomPrivateLayers(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("src", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+	private, err := db.CreateLayer("src", "owner", "notes", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		room   string
+		layers string // request layers, empty is all
+		want   int
+		copied int // layers in the new room
+	}{
+		{"guest gets the public layers", "guest", "guest-copy", "", http.StatusOK, 1},
+		{"guest asks for a private layer", "guest", "guest-private", fmt.Sprint(private), http.StatusForbidden, 0},
+		{"owner gets every layer", "owner", "owner-copy", "", http.StatusOK, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := fmt.Sprintf(`{"sourceRoomId":"src","roomId":%q,"layers":[%s]}`, tt.room, tt.layers)
+			req := httptest.NewRequest(http.MethodPost, "/clone-room", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			CloneRoom(nil).ServeHTTP(rec, asUser(req, tt.user))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+
+			layers, err := db.GetRoomLayers(tt.room)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) != tt.copied {
+				t.Fatalf("%s has %d layers, want %d", tt.room, len(layers), tt.copied)
+			}
+		})
+	}
+}
+
+func TestImportRoomKeepMembers(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("src", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.JoinRoom("src", "mod", config.RoleModerator); err != nil {
+		t.Fatal(err)
+	}
+	db.Flush()
+
+	archive, err := db.ExportRoom("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		user string
+		room string
+		role int64 // of mod in the new room, -1 when not a member
+	}{
+		// anyone holding the archive could name themselves in it
+		{"not the source owner", "stranger", "stranger-copy", -1},
+		{"source owner", "owner", "owner-copy", int64(config.RoleModerator)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/import-room?keepMembers=1&roomId="+tt.room, bytes.NewReader(body))
+			rec := httptest.NewRecorder()
+			ImportRoom(nil).ServeHTTP(rec, asUser(req, tt.user))
+			db.Flush()
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			access, err := db.GetRoomAccess(tt.room, "mod")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if access.RoomRole != tt.role {
+				t.Fatalf("mod has room role %d, want %d", access.RoomRole, tt.role)
+			}
+		})
+	}
+}
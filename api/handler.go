@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -58,7 +59,8 @@ func UploadHandler(client *s3.PresignClient) http.HandlerFunc {
 			}
 		}
 
-		objectKey := fmt.Sprintf("rooms/%s/%s-%d", req.RoomId, userId, time.Now().UnixNano())
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+		objectKey := fmt.Sprintf("rooms/%s/%s-%d", roomID, userId, time.Now().UnixNano())
 
 		presignedReq, err := client.PresignPutObject(r.Context(), &s3.PutObjectInput{
 			Bucket:       aws.String(os.Getenv("R2_BUCKET")),
@@ -84,9 +86,13 @@ func UploadHandler(client *s3.PresignClient) http.HandlerFunc {
 func GetObject(client *s3.PresignClient) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		// only objects of the room the caller was checked against
 		objectKey := r.URL.Query().Get("key")
-		if objectKey == "" {
+		if !strings.HasPrefix(objectKey, "rooms/"+roomID+"/") {
 			http.Error(w, "key require", http.StatusBadRequest)
+			return
 		}
 
 		presignedReq, err := client.PresignGetObject(r.Context(), &s3.GetObjectInput{
@@ -111,27 +117,92 @@ func GetObject(client *s3.PresignClient) http.HandlerFunc {
 func GetReplay() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		roomID := r.URL.Query().Get("roomId")
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		// from is the clock the caller already shows, 0 or missing for all of it
 		from := r.URL.Query().Get("from")
-		if roomID == "" {
-			http.Error(w, "roomId required", http.StatusBadRequest)
-			return
+		if from != "" {
+			if _, err := strconv.ParseInt(from, 10, 64); err != nil {
+				http.Error(w, "invalid from", http.StatusBadRequest)
+				return
+			}
 		}
 
 		layerStr := r.URL.Query().Get("layerIndex")
 		layerIndex, err := strconv.ParseInt(layerStr, 10, 0)
 		if err != nil {
-			http.Error(w, "parse int fail", 500)
+			http.Error(w, "invalid layerIndex", http.StatusBadRequest)
+			return
+		}
+
+		canUse, err := db.CheckCanUseLayer(roomID, layerIndex, userID)
+		if err != nil {
+			http.Error(w, "cannot check layer", http.StatusInternalServerError)
+			return
+		}
+		if !canUse {
+			http.Error(w, "no perm", http.StatusForbidden)
+			return
+		}
+
+		// to is a clock, at a unix ms timestamp, either replays history
+		seekTo, err := optionalInt(r, "to")
+		if err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+		seekAt, err := optionalInt(r, "at")
+		if err != nil {
+			http.Error(w, "invalid at", http.StatusBadRequest)
 			return
 		}
 
-		replay, err := ws.GetReplay(r.Context().Value(config.ContextUserIDKey).(string), roomID, layerIndex, from)
+		to, err := ws.SeekClock(roomID, seekTo, seekAt)
+		if err != nil {
+			fmt.Printf("Error resolving replay clock: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if to <= 0 && seekAt != nil {
+			// nothing was drawn yet at that time
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode([]config.ServerMsg{})
+			return
+		}
+
+		replay, err := ws.GetReplay(userID, roomID, layerIndex, from, to)
+		switch {
+		case errors.Is(err, db.ErrCompacted):
+			http.Error(w, "clock is older than the compacted history", http.StatusGone)
+			return
+		case errors.Is(err, db.ErrForbidden):
+			http.Error(w, "no perm", http.StatusForbidden)
+			return
+		case err != nil:
+			fmt.Printf("Error loading replay: %v\n", err)
+			http.Error(w, "cannot load board", http.StatusInternalServerError)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(replay)
 	}
 }
 
+// optionalInt is a query param that may be missing, nil when it is
+func optionalInt(r *http.Request, name string) (*int64, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
 type AddUserReq struct {
 	RoomID string `json:"roomId"`
 	User   string `json:"user"` // email or userId
@@ -141,6 +212,7 @@ type AddUserReq struct {
 func OwnerAddUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ownerID := r.Context().Value(config.ContextUserIDKey).(string)
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
 
 		var req AddUserReq
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -148,12 +220,6 @@ func OwnerAddUser() http.HandlerFunc {
 			return
 		}
 
-		// permission check
-		result, err := db.CheckcanEditRoom(req.RoomID, ownerID)
-		if err != nil || !PermHelper(&result, w) {
-			return
-		}
-
 		targetUserID := req.User
 		if strings.Contains(req.User, "@") {
 			uid, err := db.GetUserIDByEmail(req.User)
@@ -164,7 +230,125 @@ func OwnerAddUser() http.HandlerFunc {
 			targetUserID = uid
 		}
 
-		db.JoinRoom(req.RoomID, targetUserID, config.IntToRole(req.Role))
+		role := config.IntToRole(req.Role)
+		if err := db.JoinRoom(roomID, targetUserID, role); err != nil {
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		db.Audit(roomID, ownerID, targetUserID, "add-user", role)
+		ws.SetRole(roomID, targetUserID, role)
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type RoomReq struct {
+	RoomID    string `json:"roomId"`
+	Public    bool   `json:"public"`    // create only
+	Anonymous bool   `json:"anonymous"` // set-room-anonymous only
+}
+
+type RoomRes struct {
+	RoomID string      `json:"roomId"`
+	Role   config.Role `json:"role"`
+}
+
+// JoinRoom is the only way to become a member of a public room, opening
+// it only views. Members keep the role they have.
+func JoinRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		role, err := db.JoinRoomAs(roomID, userID)
+		switch {
+		case errors.Is(err, db.ErrRoomNotFound):
+			http.Error(w, "room not exist", http.StatusNotFound)
+			return
+		case errors.Is(err, db.ErrForbidden):
+			http.Error(w, "no perm", http.StatusForbidden)
+			return
+		case err != nil:
+			fmt.Printf("Error joining room: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		ws.SetRole(roomID, userID, role)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(RoomRes{RoomID: roomID, Role: role})
+	}
+}
+
+// CreateRoom creates a room owned by the caller
+func CreateRoom() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+
+		var req RoomReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RoomID == "" {
+			http.Error(w, "roomId required", http.StatusBadRequest)
+			return
+		}
+
+		err := db.CreateRoomAs(req.RoomID, userID, req.Public)
+		if errors.Is(err, db.ErrRoomExists) {
+			http.Error(w, "room already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error creating room: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(RoomRes{RoomID: req.RoomID, Role: config.RoleOwner})
+	}
+}
+
+// SetRoomAnonymous lets the owner open a public room to viewers without an
+// account, they connect to /ws without a token and can only watch
+func SetRoomAnonymous() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req RoomReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		err := db.SetRoomAnonymous(roomID, req.Anonymous)
+		if errors.Is(err, db.ErrRoomNotFound) {
+			http.Error(w, "room not exist", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error saving room anonymous: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		if !req.Anonymous {
+			ws.DropAnonymous(roomID)
+		}
+
 		w.WriteHeader(http.StatusOK)
 	}
 }
@@ -172,7 +356,7 @@ func OwnerAddUser() http.HandlerFunc {
 func GetAllUserInRoom() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		roomID := r.URL.Query().Get("roomId")
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
 		users, err := db.GetAllUserInRoom(roomID)
 		if err != nil {
 			http.Error(w, "cannot get users", 500)
@@ -200,9 +384,23 @@ func GetAllBoardsHandler() http.HandlerFunc {
 			return
 		}
 
+		for i := range rooms {
+			rooms[i].Thumbnail = ThumbnailURL(rooms[i].RoomID)
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(rooms); err != nil {
 			http.Error(w, "Encoding error", http.StatusInternalServerError)
 		}
 	}
 }
+
+func GetStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ws": ws.Stats.Snapshot(),
+			"db": db.Stats.Snapshot(),
+		})
+	}
+}
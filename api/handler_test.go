@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/middleware"
+)
+
+// asUser is what RequireSession leaves on the context
+func asUser(r *http.Request, userID string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), config.ContextUserIDKey, userID))
+}
+
+func TestAddUserRoomMismatch(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "attacker", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRoomAs("victim", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(OwnerAddUser(), config.RoleOwner)
+	body := `{"roomId":"victim","user":"attacker","role":3}`
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"query and body disagree", "?roomId=mine", http.StatusBadRequest},
+		{"body room only", "", http.StatusForbidden},
+		{"query room only", "?roomId=victim", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/add-user"+tt.query, strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, "attacker"))
+			db.Flush()
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+
+			role, ok, err := db.RoomRole("victim", "attacker")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok && role > config.RoleGuest {
+				t.Fatalf("attacker got role %d in victim", role)
+			}
+		})
+	}
+}
+
+func TestAddUserContextRoom(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "owner", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the body names no room, the handler must use the checked one
+	h := middleware.RequireRoomRole(OwnerAddUser(), config.RoleOwner)
+	req := httptest.NewRequest(http.MethodPost, "/add-user?roomId=mine", strings.NewReader(`{"user":"friend","role":2}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, asUser(req, "owner"))
+	db.Flush()
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	role, ok, err := db.RoomRole("mine", "friend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || role != config.RoleModerator {
+		t.Fatalf("friend has role %d (%v), want %d", role, ok, config.RoleModerator)
+	}
+}
+
+func TestGetObjectOtherRoomKey(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "attacker", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRoomAs("victim", "owner", false); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(GetObject(nil), config.RoleGuest)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"key of another room", "?roomId=mine&key=rooms/victim/x", http.StatusBadRequest},
+		{"key only", "?key=rooms/victim/x", http.StatusForbidden},
+		{"key outside rooms", "?roomId=mine&key=secret", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/get"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, "attacker"))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetRoomAnonymousRoom(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "attacker", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRoomAs("victim", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(SetRoomAnonymous(), config.RoleOwner)
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		want  int
+	}{
+		{"other room in body", "?roomId=mine", `{"roomId":"victim","anonymous":true}`, http.StatusBadRequest},
+		{"body room only", "", `{"roomId":"victim","anonymous":true}`, http.StatusForbidden},
+		{"query room only", "?roomId=mine", `{"anonymous":true}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/set-room-anonymous"+tt.query, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, "attacker"))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	for room, want := range map[string]bool{"mine": true, "victim": false} {
+		access, err := db.GetRoomAccess(room, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if access.Anonymous != want {
+			t.Fatalf("%s anonymous %v, want %v", room, access.Anonymous, want)
+		}
+	}
+}
+
+func TestGetReplayBadInput(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(GetReplay(), config.RoleGuest)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{"live", "&layerIndex=0", http.StatusOK},
+		{"resume", "&layerIndex=0&from=3", http.StatusOK},
+		{"bad layer", "&layerIndex=x", http.StatusBadRequest},
+		{"bad from", "&layerIndex=0&from=x", http.StatusBadRequest},
+		{"bad ranged from", "&layerIndex=0&from=x&to=5", http.StatusBadRequest},
+		{"bad to", "&layerIndex=0&to=x", http.StatusBadRequest},
+		{"bad at", "&layerIndex=0&at=x", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/replay?roomId=mine"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, "owner"))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestGetReplayPrivateLayer(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := db.CreateLayer("mine", "owner", "notes", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(GetReplay(), config.RoleGuest)
+
+	for user, want := range map[string]int{"owner": http.StatusOK, "guest": http.StatusForbidden} {
+		t.Run(user, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/replay?roomId=mine&layerIndex=%d", layer), nil)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, user))
+
+			if rec.Code != want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, want, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRoomBodyTooLarge(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(OwnerAddUser(), config.RoleOwner)
+	body := `{"roomId":"mine","user":"` + strings.Repeat("x", middleware.MaxRoomBodyBytes) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/add-user", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, asUser(req, "owner"))
+
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusRequestEntityTooLarge)
+	}
+}
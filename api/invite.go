@@ -0,0 +1,209 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/auth"
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/ws"
+	"github.com/google/uuid"
+)
+
+var (
+	DefaultInviteTTL = 7 * 24 * time.Hour
+	MaxInviteTTL     = 90 * 24 * time.Hour
+)
+
+type CreateInviteReq struct {
+	RoomID       string `json:"roomId"`
+	Role         int    `json:"role"`
+	ExpiresInSec int64  `json:"expiresIn"` // 0 is DefaultInviteTTL
+	MaxUses      int    `json:"maxUses"`   // 0 is unlimited
+}
+
+type InviteRes struct {
+	Invite config.Invite `json:"invite"`
+	Token  string        `json:"token"`
+	URL    string        `json:"url,omitempty"` // INVITE_URL with the token
+}
+
+// CreateInvite mints a signed invite link for the room, the invitee does
+// not need an account yet, they redeem it after logging in (AcceptInvite).
+func CreateInvite() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ownerID := r.Context().Value(config.ContextUserIDKey).(string)
+		roomID, _ := r.Context().Value(config.ContextRoomIDKey).(string)
+		if roomID == "" {
+			http.Error(w, "roomId required", http.StatusBadRequest)
+			return
+		}
+
+		var req CreateInviteReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+		if req.Role < int(config.RoleGuest) || req.Role > int(config.RoleOwner) {
+			http.Error(w, "invalid role", http.StatusBadRequest)
+			return
+		}
+		if req.MaxUses < 0 {
+			http.Error(w, "invalid maxUses", http.StatusBadRequest)
+			return
+		}
+
+		ttl := DefaultInviteTTL
+		if req.ExpiresInSec > 0 {
+			ttl = time.Duration(req.ExpiresInSec) * time.Second
+		}
+		if ttl > MaxInviteTTL {
+			http.Error(w, "expiresIn too long", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		inv := config.Invite{
+			ID:        uuid.NewString(),
+			RoomID:    roomID,
+			Role:      config.IntToRole(req.Role),
+			CreatedBy: ownerID,
+			MaxUses:   req.MaxUses,
+			ExpiresAt: now.Add(ttl).UnixMilli(),
+			CreatedAt: now.UnixMilli(),
+		}
+
+		token, err := auth.CreateInviteJWT(inv)
+		if err != nil {
+			http.Error(w, "auth error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := db.CreateInvite(inv); err != nil {
+			fmt.Printf("Error creating invite: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		res := InviteRes{Invite: inv, Token: token}
+		if base := os.Getenv("INVITE_URL"); base != "" {
+			res.URL = base + "?invite=" + url.QueryEscape(token)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+func ListInvites() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		invites, err := db.GetRoomInvites(roomID)
+		if err != nil {
+			fmt.Printf("Error listing invites: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(invites)
+	}
+}
+
+type RevokeInviteReq struct {
+	RoomID string `json:"roomId"`
+	ID     string `json:"id"`
+}
+
+func RevokeInvite() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		roomID, _ := r.Context().Value(config.ContextRoomIDKey).(string)
+		if roomID == "" {
+			http.Error(w, "roomId required", http.StatusBadRequest)
+			return
+		}
+
+		var req RevokeInviteReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		err := db.RevokeInvite(roomID, req.ID)
+		if errors.Is(err, db.ErrInviteNotFound) {
+			http.Error(w, "invite not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error revoking invite: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+type AcceptInviteReq struct {
+	Token string `json:"token"`
+}
+
+// AcceptInvite redeems an invite token for the session user
+func AcceptInvite() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+
+		var req AcceptInviteReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "token required", http.StatusBadRequest)
+			return
+		}
+
+		claims, err := auth.ParseInviteJWT(req.Token)
+		if err != nil {
+			http.Error(w, "invalid invite", http.StatusForbidden)
+			return
+		}
+
+		role, err := db.RedeemInvite(claims.ID, userID)
+		switch {
+		case errors.Is(err, db.ErrInviteNotFound):
+			http.Error(w, "invite not found", http.StatusNotFound)
+			return
+		case errors.Is(err, db.ErrInviteInvalid):
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		case err != nil:
+			fmt.Printf("Error redeeming invite: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		ws.SetRole(claims.RoomID, userID, role)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(RoomRes{RoomID: claims.RoomID, Role: role})
+	}
+}
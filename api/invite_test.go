@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/middleware"
+)
+
+func TestCreateInviteRoom(t *testing.T) {
+	db.OpenTestStore(t)
+	t.Setenv("JWT_SECRET", "test")
+
+	if err := db.CreateRoomAs("mine", "attacker", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRoomAs("victim", "owner", false); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(CreateInvite(), config.RoleOwner)
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		want  int
+		room  string // of the stored invite
+	}{
+		{"other room in body", "?roomId=mine", `{"roomId":"victim","role":3}`, http.StatusBadRequest, ""},
+		{"body room only", "", `{"roomId":"victim","role":3}`, http.StatusForbidden, ""},
+		{"query room only", "?roomId=mine", `{"role":1}`, http.StatusCreated, "mine"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/create-invite"+tt.query, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, "attacker"))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.room == "" {
+				return
+			}
+
+			var res InviteRes
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Invite.RoomID != tt.room {
+				t.Fatalf("invite for %q, want %q", res.Invite.RoomID, tt.room)
+			}
+		})
+	}
+
+	invites, err := db.GetRoomInvites("victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invites) != 0 {
+		t.Fatalf("%d invites stored for victim", len(invites))
+	}
+}
+
+func TestRevokeInviteOtherRoom(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "attacker", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRoomAs("victim", "owner", false); err != nil {
+		t.Fatal(err)
+	}
+	err := db.CreateInvite(config.Invite{ID: "inv", RoomID: "victim", Role: config.RoleMember, CreatedBy: "owner", ExpiresAt: 1 << 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the invite id belongs to victim, revoking it from mine finds nothing
+	h := middleware.RequireRoomRole(RevokeInvite(), config.RoleOwner)
+	req := httptest.NewRequest(http.MethodPost, "/revoke-invite?roomId=mine", strings.NewReader(`{"id":"inv"}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, asUser(req, "attacker"))
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	invites, err := db.GetRoomInvites("victim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invites) != 1 || invites[0].Revoked {
+		t.Fatalf("victim invite changed: %+v", invites)
+	}
+}
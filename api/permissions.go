@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/ws"
+)
+
+type RoomPermissionsRes struct {
+	Overrides config.Permissions `json:"overrides"`
+	Effective config.Permissions `json:"effective"`
+}
+
+// GetRoomPermissions shows the ws permission matrix of a room to anyone who
+// can view it, so clients can hide tools the user may not use.
+func GetRoomPermissions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		overrides, err := db.GetRoomPermissions(roomID)
+		if err != nil {
+			fmt.Printf("Error loading room permissions: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(RoomPermissionsRes{
+			Overrides: overrides,
+			Effective: config.DefaultPermissions.With(overrides),
+		})
+	}
+}
+
+type SetRoomPermissionsReq struct {
+	RoomID      string         `json:"roomId"`
+	Permissions map[string]int `json:"permissions"` // op -> role, replaces every override
+}
+
+// SetRoomPermissions lets the owner replace the overrides of a room, an
+// empty map goes back to config.DefaultPermissions.
+func SetRoomPermissions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req SetRoomPermissionsReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid body", http.StatusBadRequest)
+			return
+		}
+
+		perms := config.Permissions{}
+		for op, role := range req.Permissions {
+			if !config.ValidPermissionKey(op) {
+				http.Error(w, "unknown operation "+op, http.StatusBadRequest)
+				return
+			}
+			if role < int(config.RoleGuest) || role > int(config.RoleOwner) {
+				http.Error(w, "invalid role for "+op, http.StatusBadRequest)
+				return
+			}
+			perms[op] = config.Role(role)
+		}
+
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		if err := db.SetRoomPermissions(roomID, perms); err != nil {
+			fmt.Printf("Error saving room permissions: %v\n", err)
+			http.Error(w, "db error", http.StatusInternalServerError)
+			return
+		}
+		ws.InvalidatePermissions(roomID)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(RoomPermissionsRes{
+			Overrides: perms,
+			Effective: config.DefaultPermissions.With(perms),
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/middleware"
+)
+
+func TestSetRoomPermissionsRoom(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "attacker", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateRoomAs("victim", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(SetRoomPermissions(), config.RoleOwner)
+
+	tests := []struct {
+		name  string
+		query string
+		body  string
+		want  int
+	}{
+		{"other room in body", "?roomId=mine", `{"roomId":"victim","permissions":{"*":0}}`, http.StatusBadRequest},
+		{"body room only", "", `{"roomId":"victim","permissions":{"*":0}}`, http.StatusForbidden},
+		{"query room only", "?roomId=mine", `{"permissions":{"*":0}}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/set-room-permissions"+tt.query, strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, asUser(req, "attacker"))
+
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+
+	for room, want := range map[string]int{"mine": 1, "victim": 0} {
+		perms, err := db.GetRoomPermissions(room)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(perms) != want {
+			t.Fatalf("%s has %d overrides, want %d", room, len(perms), want)
+		}
+	}
+}
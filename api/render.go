@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/render"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// RenderSVG serves ?roomId=&layerIndex=&clock= as an svg, clock 0 or
+// missing renders the current board.
+func RenderSVG(client *s3.PresignClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		scene, ok := loadScene(w, r, userID)
+		if !ok {
+			return
+		}
+
+		// the svg is served from the api origin, it must not run anything
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src *")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		err := render.SVG(w, scene, render.Options{
+			ObjectURL: objectURL(r.Context(), client, roomID),
+		})
+		if err != nil {
+			fmt.Printf("Error rendering svg: %v\n", err)
+		}
+	}
+}
+
+// loadScene reads the render query params, checks the caller may see the
+// layer and loads it. It writes the error response itself.
+func loadScene(w http.ResponseWriter, r *http.Request, userID string) (render.Scene, bool) {
+	q := r.URL.Query()
+
+	roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+	var layerIndex, clock int64
+	var err error
+	if s := q.Get("layerIndex"); s != "" {
+		if layerIndex, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid layerIndex", http.StatusBadRequest)
+			return render.Scene{}, false
+		}
+	}
+	if s := q.Get("clock"); s != "" {
+		if clock, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "invalid clock", http.StatusBadRequest)
+			return render.Scene{}, false
+		}
+	}
+
+	canUse, err := db.CheckCanUseLayer(roomID, layerIndex, userID)
+	if err != nil {
+		http.Error(w, "cannot check layer", http.StatusInternalServerError)
+		return render.Scene{}, false
+	}
+	if !canUse {
+		http.Error(w, "no perm", http.StatusForbidden)
+		return render.Scene{}, false
+	}
+
+	strokes, doms, err := db.GetLayerStateAt(roomID, layerIndex, clock)
+	if errors.Is(err, db.ErrCompacted) {
+		http.Error(w, "clock is older than the compacted history", http.StatusGone)
+		return render.Scene{}, false
+	}
+	if err != nil {
+		fmt.Printf("Error loading layer state: %v\n", err)
+		http.Error(w, "cannot load board", http.StatusInternalServerError)
+		return render.Scene{}, false
+	}
+
+	return render.NewScene(strokes, doms), true
+}
+
+// objectURL links uploaded objects of roomID: R2_PUBLIC_URL when the
+// bucket is public, otherwise a presigned url that lives as long as /get
+// ones. Other payloads are kept only when they are http(s) urls, keys of
+// other rooms are never signed.
+func objectURL(ctx context.Context, client *s3.PresignClient, roomID string) func(config.DomObjectNetwork) string {
+	public := strings.TrimSuffix(os.Getenv("R2_PUBLIC_URL"), "/")
+
+	return func(d config.DomObjectNetwork) string {
+		if url := render.SafeURL(d.Payload); url != "" {
+			return url
+		}
+		if !strings.HasPrefix(d.ID, "rooms/"+roomID+"/") {
+			return ""
+		}
+		if public != "" {
+			return public + "/" + d.ID
+		}
+
+		req, err := client.PresignGetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(os.Getenv("R2_BUCKET")),
+			Key:    aws.String(d.ID),
+		}, func(opts *s3.PresignOptions) {
+			opts.Expires = 1 * time.Hour
+		})
+		if err != nil {
+			return ""
+		}
+		return req.URL
+	}
+}
+
+// ExportPDF serves ?roomId=&clock= as a pdf with one page per layer the
+// caller can use, layers they can not see are left out.
+func ExportPDF(client *s3.PresignClient) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(config.ContextUserIDKey).(string)
+
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		var clock int64
+		if s := r.URL.Query().Get("clock"); s != "" {
+			var err error
+			if clock, err = strconv.ParseInt(s, 10, 64); err != nil {
+				http.Error(w, "invalid clock", http.StatusBadRequest)
+				return
+			}
+		}
+
+		layers, err := db.GetRoomLayers(roomID)
+		if err != nil {
+			fmt.Printf("Error fetching layers: %v\n", err)
+			http.Error(w, "cannot load board", http.StatusInternalServerError)
+			return
+		}
+
+		var pages []render.Page
+		for _, l := range layers {
+			canUse, err := db.CheckCanUseLayer(roomID, l.Index, userID)
+			if err != nil {
+				http.Error(w, "cannot check layer", http.StatusInternalServerError)
+				return
+			}
+			if !canUse {
+				continue
+			}
+
+			strokes, doms, err := db.GetLayerStateAt(roomID, l.Index, clock)
+			if errors.Is(err, db.ErrCompacted) {
+				http.Error(w, "clock is older than the compacted history", http.StatusGone)
+				return
+			}
+			if err != nil {
+				fmt.Printf("Error loading layer state: %v\n", err)
+				http.Error(w, "cannot load board", http.StatusInternalServerError)
+				return
+			}
+
+			title := l.Name
+			if title == "" {
+				title = "Layer " + strconv.FormatInt(l.Index, 10)
+			}
+			pages = append(pages, render.Page{
+				Title: roomID + " / " + title,
+				Scene: render.NewScene(strokes, doms),
+			})
+		}
+
+		if len(pages) == 0 {
+			http.Error(w, "no perm", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "room-"+roomID+".pdf"))
+		err = render.PDF(w, pages, render.Options{
+			ObjectURL: objectURL(r.Context(), client, roomID),
+		})
+		if err != nil {
+			fmt.Printf("Error rendering pdf: %v\n", err)
+		}
+	}
+}
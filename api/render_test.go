@@ -0,0 +1,63 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/middleware"
+)
+
+func TestObjectURL(t *testing.T) {
+	t.Setenv("R2_PUBLIC_URL", "https://cdn.example.com/")
+	link := objectURL(context.Background(), nil, "mine")
+
+	tests := []struct {
+		name string
+		dom  config.DomObjectNetwork
+		want string
+	}{
+		{"own upload", config.DomObjectNetwork{ID: "rooms/mine/a.png"}, "https://cdn.example.com/rooms/mine/a.png"},
+		{"other room upload", config.DomObjectNetwork{ID: "rooms/victim/a.png"}, ""},
+		{"https payload", config.DomObjectNetwork{ID: "x", Payload: "https://example.com/a.png"}, "https://example.com/a.png"},
+		{"javascript payload", config.DomObjectNetwork{ID: "rooms/mine/a", Payload: "javascript:alert(1)"}, "https://cdn.example.com/rooms/mine/a"},
+		{"javascript payload, no upload", config.DomObjectNetwork{ID: "x", Payload: "javascript:alert(1)"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := link(tt.dom); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRenderSVGHeaders(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("mine", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	h := middleware.RequireRoomRole(RenderSVG(nil), config.RoleGuest)
+	req := httptest.NewRequest(http.MethodGet, "/render.svg?roomId=mine", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, asUser(req, "owner"))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	want := map[string]string{
+		"Content-Type":            "image/svg+xml",
+		"Content-Security-Policy": "default-src 'none'; img-src *",
+		"X-Content-Type-Options":  "nosniff",
+	}
+	for k, v := range want {
+		if got := rec.Header().Get(k); got != v {
+			t.Errorf("%s: %q, want %q", k, got, v)
+		}
+	}
+}
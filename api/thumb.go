@@ -0,0 +1,39 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/thumb"
+)
+
+// ThumbnailURL is the listing link, v changes with every redraw so the
+// png itself can be cached for long.
+func ThumbnailURL(roomID string) string {
+	return "/thumbnail?roomId=" + url.QueryEscape(roomID) +
+		"&v=" + strconv.FormatInt(thumb.Version(roomID), 10)
+}
+
+func GetThumbnail() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		roomID := r.Context().Value(config.ContextRoomIDKey).(string)
+
+		png, clock, err := thumb.Get(roomID)
+		if err != nil {
+			fmt.Printf("Error drawing thumbnail: %v\n", err)
+			http.Error(w, "cannot draw thumbnail", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Query().Get("v") == strconv.FormatInt(clock, 10) {
+			w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "private, no-cache")
+		}
+		w.Write(png)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/Tk21111/whiteboard_server/config"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -38,8 +39,61 @@ func ParseJWT(tokenStr string) (*Claims, error) {
 		return nil, err
 	}
 
+	// invite tokens share the secret but carry no user
 	claims, ok := token.Claims.(*Claims)
-	if !ok || !token.Valid {
+	if !ok || !token.Valid || claims.UserID == "" {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	return claims, nil
+}
+
+// inviteAudience keeps invite and session tokens apart
+const inviteAudience = "invite"
+
+// InviteClaims is what an invite link carries, ID is the invites row.
+// The row has the final say on uses and revocation.
+type InviteClaims struct {
+	RoomID  string      `json:"room"`
+	Role    config.Role `json:"role"`
+	MaxUses int         `json:"maxUses,omitempty"`
+	jwt.RegisteredClaims
+}
+
+func CreateInviteJWT(inv config.Invite) (string, error) {
+	claims := InviteClaims{
+		RoomID:  inv.RoomID,
+		Role:    inv.Role,
+		MaxUses: inv.MaxUses,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        inv.ID,
+			Audience:  jwt.ClaimStrings{inviteAudience},
+			ExpiresAt: jwt.NewNumericDate(time.UnixMilli(inv.ExpiresAt)),
+			IssuedAt:  jwt.NewNumericDate(time.UnixMilli(inv.CreatedAt)),
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
+func ParseInviteJWT(tokenStr string) (*InviteClaims, error) {
+	token, err := jwt.ParseWithClaims(
+		tokenStr,
+		&InviteClaims{},
+		func(t *jwt.Token) (interface{}, error) {
+			return []byte(os.Getenv("JWT_SECRET")), nil
+		},
+		jwt.WithAudience(inviteAudience),
+		jwt.WithExpirationRequired(),
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*InviteClaims)
+	if !ok || !token.Valid || claims.ID == "" {
 		return nil, jwt.ErrTokenInvalidClaims
 	}
 
@@ -0,0 +1,267 @@
+package backup
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3 is the part of *s3.Client backups use, R2 and MinIO both speak it.
+type S3 interface {
+	PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+const keyPrefix = "events-"
+
+// ConfigFromEnv reads BACKUP_INTERVAL (e.g. "6h", unset disables the
+// schedule), BACKUP_PREFIX, BACKUP_KEEP and the bucket from BACKUP_BUCKET or
+// R2_BUCKET.
+func ConfigFromEnv() config.BackupConfig {
+	cfg := config.BackupConfig{
+		Bucket: os.Getenv("BACKUP_BUCKET"),
+		Prefix: os.Getenv("BACKUP_PREFIX"),
+		Keep:   14,
+	}
+	if cfg.Bucket == "" {
+		cfg.Bucket = os.Getenv("R2_BUCKET")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "backups/"
+	}
+	if interval, err := time.ParseDuration(os.Getenv("BACKUP_INTERVAL")); err == nil {
+		cfg.Interval = interval
+	}
+	if keep, err := strconv.Atoi(os.Getenv("BACKUP_KEEP")); err == nil {
+		cfg.Keep = keep
+	}
+	return cfg
+}
+
+func Start(client S3, store db.Store, cfg config.BackupConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+
+	go func() {
+		for range ticker.C {
+			key, err := Run(context.Background(), client, store, cfg)
+			if err != nil {
+				fmt.Println("[backup] failed:", err)
+				continue
+			}
+			fmt.Println("[backup] uploaded", key)
+		}
+	}()
+}
+
+// Run takes one online backup, uploads it gzipped and prunes old ones.
+func Run(ctx context.Context, client S3, store db.Store, cfg config.BackupConfig) (string, error) {
+	b, ok := store.(db.Backuper)
+	if !ok {
+		return "", fmt.Errorf("%s store has no online backup, use the backend's own tooling", store.Name())
+	}
+
+	dir, err := os.MkdirTemp("", "wb-backup")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	raw := filepath.Join(dir, "events.db")
+	if err := b.BackupTo(raw); err != nil {
+		return "", err
+	}
+
+	gz := raw + ".gz"
+	if err := gzipFile(raw, gz); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(gz)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	key := cfg.Prefix + keyPrefix + time.Now().UTC().Format("20060102T150405Z") + ".db.gz"
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(cfg.Bucket),
+		Key:         aws.String(key),
+		Body:        f,
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := prune(ctx, client, cfg); err != nil {
+		fmt.Println("[backup] prune failed:", err)
+	}
+
+	return key, nil
+}
+
+// List returns backup keys oldest first, keys sort by their timestamp.
+func List(ctx context.Context, client S3, cfg config.BackupConfig) ([]string, error) {
+	var keys []string
+	var token *string
+
+	for {
+		out, err := client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(cfg.Bucket),
+			Prefix:            aws.String(cfg.Prefix + keyPrefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range out.Contents {
+			keys = append(keys, aws.ToString(obj.Key))
+		}
+
+		if !aws.ToBool(out.IsTruncated) {
+			break
+		}
+		token = out.NextContinuationToken
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func prune(ctx context.Context, client S3, cfg config.BackupConfig) error {
+	if cfg.Keep <= 0 {
+		return nil
+	}
+
+	keys, err := List(ctx, client, cfg)
+	if err != nil {
+		return err
+	}
+
+	for len(keys) > cfg.Keep {
+		_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(cfg.Bucket),
+			Key:    aws.String(keys[0]),
+		})
+		if err != nil {
+			return err
+		}
+		keys = keys[1:]
+	}
+	return nil
+}
+
+// Restore rebuilds the sqlite file at dest from a backup, the newest one
+// when key is empty. With toClock > 0 everything after that clock is
+// dropped (see db.RewindSQLite). The current file is kept next to dest as
+// dest.pre-restore-<ts>. Run it with the server stopped.
+func Restore(ctx context.Context, client S3, cfg config.BackupConfig, key string, dest string, toClock int64) (string, error) {
+	if key == "" {
+		keys, err := List(ctx, client, cfg)
+		if err != nil {
+			return "", err
+		}
+		if len(keys) == 0 {
+			return "", errors.New("no backups found")
+		}
+		key = keys[len(keys)-1]
+	}
+
+	out, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(cfg.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer out.Body.Close()
+
+	tmp := dest + ".restore"
+	if err := gunzipTo(out.Body, tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if toClock > 0 {
+		if err := db.RewindSQLite(tmp, toClock); err != nil {
+			os.Remove(tmp)
+			return "", err
+		}
+	}
+
+	if err := db.VerifySQLite(tmp); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	// keep the old db (and its wal) together, they only make sense as a set
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		err := os.Rename(dest+suffix, dest+".pre-restore-"+stamp+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func gzipFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func gunzipTo(r io.Reader, dst string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, zr); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,211 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// fakeS3 keeps objects in memory, List pages two keys at a time so the
+// continuation path runs too
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	f.objects[aws.ToString(in.Key)] = data
+	f.mu.Unlock()
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	data, ok := f.objects[aws.ToString(in.Key)]
+	f.mu.Unlock()
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, in *s3.ListObjectsV2Input, opts ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, aws.ToString(in.Prefix)) {
+			keys = append(keys, k)
+		}
+	}
+	f.mu.Unlock()
+	sort.Strings(keys)
+
+	// the token is the last key of the previous page
+	if in.ContinuationToken != nil {
+		i := sort.SearchStrings(keys, *in.ContinuationToken)
+		keys = keys[i+1:]
+	}
+
+	out := &s3.ListObjectsV2Output{}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[1])
+	}
+	for _, k := range keys {
+		out.Contents = append(out.Contents, types.Object{Key: aws.String(k)})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	delete(f.objects, aws.ToString(in.Key))
+	f.mu.Unlock()
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// seedRoom writes strokes at every clock up to 10, a dom added at 3 and
+// removed at 8
+func seedRoom(t *testing.T, roomID string) {
+	t.Helper()
+
+	dom := config.DomObjectNetwork{ID: "dom", Kind: "img", Transform: config.Transform{W: 10, H: 10}}
+	domAdd, _ := json.Marshal(config.NetworkMsg{Operation: "dom-add", ID: "dom", DomObject: &dom})
+	domRemove, _ := json.Marshal(config.NetworkMsg{Operation: "dom-remove", ID: "dom"})
+
+	for clock := int64(1); clock <= 10; clock++ {
+		e := config.Event{
+			EventMeta: config.EventMeta{ID: clock, RoomID: roomID, UserID: "u"},
+			EntityID:  fmt.Sprint("s", clock),
+			Op:        "stroke-add",
+			Payload:   json.RawMessage(`{}`),
+			CreatedAt: clock,
+		}
+		switch clock {
+		case 3:
+			e.EntityID, e.Op, e.Payload = "dom", "dom-add", domAdd
+			db.WriteDom(config.DomEvent{DomObjectNetwork: dom, RoomID: roomID, UserID: "u"}, db.OpDomCreate)
+		case 8:
+			e.EntityID, e.Op, e.Payload = "dom", "dom-remove", domRemove
+			db.RemoveDom("dom", roomID)
+		}
+		db.WriteEvent(e)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupRestoreToClock(t *testing.T) {
+	store := db.OpenTestStore(t)
+	seedRoom(t, "r")
+
+	client := newFakeS3()
+	cfg := config.BackupConfig{Bucket: "b", Prefix: "backups/", Keep: 2}
+
+	// older backups past Keep are pruned, listing pages through them
+	for _, stamp := range []string{"20200101T000000Z", "20200102T000000Z", "20200103T000000Z"} {
+		client.objects[cfg.Prefix+keyPrefix+stamp+".db.gz"] = []byte("old")
+	}
+
+	key, err := Run(context.Background(), client, store, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := client.keys(); len(keys) != 2 || keys[1] != key {
+		t.Fatalf("bucket has %v, want the newest two ending in %s", keys, key)
+	}
+
+	tests := []struct {
+		name   string
+		clock  int64
+		events int
+		dom    bool // live after the restore
+	}{
+		{"latest", 0, 10, false},
+		{"before the dom remove", 6, 6, true},
+		{"before the dom add", 2, 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "events.db")
+			if err := os.WriteFile(dest, []byte("current"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// an empty key takes the newest backup
+			restored, err := Restore(context.Background(), client, cfg, "", dest, tt.clock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored != key {
+				t.Fatalf("restored %s, want %s", restored, key)
+			}
+
+			old, _ := filepath.Glob(dest + ".pre-restore-*")
+			if len(old) != 1 {
+				t.Fatalf("current db kept as %v, want one pre-restore copy", old)
+			}
+
+			s, err := db.OpenSQLite(dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			var events int
+			if err := s.QueryRow(`SELECT COUNT(*) FROM events WHERE room_id = ?`, "r").Scan(&events); err != nil {
+				t.Fatal(err)
+			}
+			if events != tt.events {
+				t.Fatalf("%d events after restoring to %d, want %d", events, tt.clock, tt.events)
+			}
+
+			_, live, err := s.GetDomObject("r", "dom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if live != tt.dom {
+				t.Fatalf("dom live %v after restoring to %d, want %v", live, tt.clock, tt.dom)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package bus
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Bus carries room broadcasts between server instances.
+type Bus interface {
+	Publish(roomID string, data []byte) error
+	// Subscribe calls fn for every message published to roomID,
+	// including the ones this instance published.
+	Subscribe(roomID string, fn func(data []byte)) (unsubscribe func(), err error)
+	Close() error
+}
+
+// Clocks is implemented by buses that can hand out room clocks shared by
+// every instance. floor is the highest clock this instance knows about.
+type Clocks interface {
+	NextClock(roomID string, floor int64) (int64, error)
+	CurrentClock(roomID string) (int64, error)
+}
+
+// FromEnv picks the bus from BUS_URL, in-process when unset.
+func FromEnv() (Bus, error) {
+	url := os.Getenv("BUS_URL")
+	if url == "" {
+		return NewLocal(), nil
+	}
+
+	b, err := NewRedis(url)
+	if err != nil {
+		return nil, fmt.Errorf("bus: %w", err)
+	}
+	return b, nil
+}
+
+/* --------------------------------------------------
+   IN-PROCESS
+   -------------------------------------------------- */
+
+type Local struct {
+	mu     sync.Mutex
+	subs   map[string]map[int]func([]byte)
+	nextID int
+}
+
+func NewLocal() *Local {
+	return &Local{
+		subs: make(map[string]map[int]func([]byte)),
+	}
+}
+
+func (l *Local) Publish(roomID string, data []byte) error {
+	l.mu.Lock()
+	fns := make([]func([]byte), 0, len(l.subs[roomID]))
+	for _, fn := range l.subs[roomID] {
+		fns = append(fns, fn)
+	}
+	l.mu.Unlock()
+
+	for _, fn := range fns {
+		fn(data)
+	}
+	return nil
+}
+
+func (l *Local) Subscribe(roomID string, fn func([]byte)) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	room, ok := l.subs[roomID]
+	if !ok {
+		room = make(map[int]func([]byte))
+		l.subs[roomID] = room
+	}
+
+	l.nextID++
+	id := l.nextID
+	room[id] = fn
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		delete(l.subs[roomID], id)
+		if len(l.subs[roomID]) == 0 {
+			delete(l.subs, roomID)
+		}
+	}, nil
+}
+
+func (l *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,366 @@
+package bus
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Redis speaks plain RESP2, so it works against redis, valkey, keydb or any
+// local stand-in that implements PUBLISH / SUBSCRIBE / EVAL.
+type Redis struct {
+	addr     string
+	password string
+
+	// command connection, one request at a time
+	mu  sync.Mutex
+	cmd net.Conn
+	rd  *bufio.Reader
+
+	// subscriber connection, read by subLoop
+	subMu    sync.Mutex
+	sub      net.Conn
+	handlers map[string]map[int]func([]byte)
+	nextID   int
+	closed   bool
+}
+
+const (
+	channelPrefix = "wb:room:"
+	clockPrefix   = "wb:clock:"
+	dialTimeout   = 5 * time.Second
+)
+
+// max(stored, floor) + 1, atomic on the server
+const nextClockScript = `
+local v = tonumber(redis.call('GET', KEYS[1]) or '0')
+local f = tonumber(ARGV[1])
+if v < f then v = f end
+v = v + 1
+redis.call('SET', KEYS[1], v)
+return v
+`
+
+// NewRedis takes redis://[:password@]host:port
+func NewRedis(rawURL string) (*Redis, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	r := &Redis{
+		addr:     u.Host,
+		handlers: make(map[string]map[int]func([]byte)),
+	}
+	if u.User != nil {
+		r.password, _ = u.User.Password()
+	}
+
+	// fail fast on a bad address
+	if _, err := r.do("PING"); err != nil {
+		return nil, err
+	}
+
+	go r.subLoop()
+	return r, nil
+}
+
+func (r *Redis) Publish(roomID string, data []byte) error {
+	_, err := r.do("PUBLISH", channelPrefix+roomID, string(data))
+	return err
+}
+
+func (r *Redis) NextClock(roomID string, floor int64) (int64, error) {
+	res, err := r.do("EVAL", nextClockScript, "1", clockPrefix+roomID, strconv.FormatInt(floor, 10))
+	if err != nil {
+		return 0, err
+	}
+
+	clock, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected clock reply %v", res)
+	}
+	return clock, nil
+}
+
+// CurrentClock is 0 when no instance assigned a clock yet
+func (r *Redis) CurrentClock(roomID string) (int64, error) {
+	res, err := r.do("GET", clockPrefix+roomID)
+	if err != nil || res == nil {
+		return 0, err
+	}
+
+	s, _ := res.(string)
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func (r *Redis) Subscribe(roomID string, fn func([]byte)) (func(), error) {
+	channel := channelPrefix + roomID
+
+	r.subMu.Lock()
+	defer r.subMu.Unlock()
+
+	room, ok := r.handlers[channel]
+	if !ok {
+		room = make(map[int]func([]byte))
+		r.handlers[channel] = room
+
+		// a down subscriber conn resubscribes everything on reconnect
+		if r.sub != nil {
+			if err := writeCommand(r.sub, "SUBSCRIBE", channel); err != nil {
+				r.sub.Close()
+			}
+		}
+	}
+
+	r.nextID++
+	id := r.nextID
+	room[id] = fn
+
+	return func() {
+		r.subMu.Lock()
+		defer r.subMu.Unlock()
+
+		delete(r.handlers[channel], id)
+		if len(r.handlers[channel]) > 0 {
+			return
+		}
+		delete(r.handlers, channel)
+		if r.sub != nil {
+			if err := writeCommand(r.sub, "UNSUBSCRIBE", channel); err != nil {
+				r.sub.Close()
+			}
+		}
+	}, nil
+}
+
+func (r *Redis) Close() error {
+	r.subMu.Lock()
+	r.closed = true
+	if r.sub != nil {
+		r.sub.Close()
+	}
+	r.subMu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd != nil {
+		return r.cmd.Close()
+	}
+	return nil
+}
+
+func (r *Redis) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.DialTimeout("tcp", r.addr, dialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	rd := bufio.NewReader(conn)
+
+	if r.password != "" {
+		if err := writeCommand(conn, "AUTH", r.password); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		if _, err := readReply(rd); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	return conn, rd, nil
+}
+
+func (r *Redis) do(args ...string) (any, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cmd == nil {
+		conn, rd, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		r.cmd, r.rd = conn, rd
+	}
+
+	_ = r.cmd.SetDeadline(time.Now().Add(dialTimeout))
+	err := writeCommand(r.cmd, args...)
+	if err == nil {
+		var res any
+		res, err = readReply(r.rd)
+		if err == nil {
+			return res, nil
+		}
+		var re redisError
+		if errors.As(err, &re) {
+			// server side error, the connection is still fine
+			return nil, err
+		}
+	}
+
+	// drop the connection, next call redials
+	r.cmd.Close()
+	r.cmd, r.rd = nil, nil
+	return nil, err
+}
+
+func (r *Redis) subLoop() {
+	backoff := 100 * time.Millisecond
+
+	for {
+		r.subMu.Lock()
+		if r.closed {
+			r.subMu.Unlock()
+			return
+		}
+		r.subMu.Unlock()
+
+		conn, rd, err := r.dial()
+		if err != nil {
+			fmt.Println("[bus] subscribe dial fail:", err)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, 10*time.Second)
+			continue
+		}
+		backoff = 100 * time.Millisecond
+
+		r.subMu.Lock()
+		r.sub = conn
+		for channel := range r.handlers {
+			if err := writeCommand(conn, "SUBSCRIBE", channel); err != nil {
+				break
+			}
+		}
+		r.subMu.Unlock()
+
+		r.readPushes(rd)
+
+		r.subMu.Lock()
+		r.sub = nil
+		r.subMu.Unlock()
+		conn.Close()
+	}
+}
+
+func (r *Redis) readPushes(rd *bufio.Reader) {
+	for {
+		res, err := readReply(rd)
+		if err != nil {
+			return
+		}
+
+		// ["message", channel, payload], subscribe acks are ignored
+		push, ok := res.([]any)
+		if !ok || len(push) != 3 {
+			continue
+		}
+		kind, _ := push[0].(string)
+		channel, _ := push[1].(string)
+		payload, _ := push[2].(string)
+		if kind != "message" {
+			continue
+		}
+
+		r.subMu.Lock()
+		fns := make([]func([]byte), 0, len(r.handlers[channel]))
+		for _, fn := range r.handlers[channel] {
+			fns = append(fns, fn)
+		}
+		r.subMu.Unlock()
+
+		for _, fn := range fns {
+			fn([]byte(payload))
+		}
+	}
+}
+
+/* --------------------------------------------------
+   RESP
+   -------------------------------------------------- */
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func writeCommand(w net.Conn, args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// readReply returns string, int64, []any, nil or a redisError
+func readReply(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis: short reply")
+	}
+	body := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return body, nil
+
+	case '-':
+		return nil, redisError(body)
+
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = readReply(rd)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+
+	return nil, fmt.Errorf("redis: unknown reply %q", line)
+}
@@ -0,0 +1,249 @@
+package bus
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want any
+		err  string
+	}{
+		{"simple string", "+OK\r\n", "OK", ""},
+		{"error", "-ERR unknown command\r\n", nil, "redis: ERR unknown command"},
+		{"integer", ":42\r\n", int64(42), ""},
+		{"negative integer", ":-1\r\n", int64(-1), ""},
+		{"bulk", "$5\r\nhello\r\n", "hello", ""},
+		{"bulk with crlf inside", "$7\r\na\r\nb\r\nc\r\n", "a\r\nb\r\nc", ""},
+		{"empty bulk", "$0\r\n\r\n", "", ""},
+		{"nil bulk", "$-1\r\n", nil, ""},
+		{"nil array", "*-1\r\n", nil, ""},
+		{"push", "*3\r\n$7\r\nmessage\r\n$9\r\nwb:room:a\r\n$2\r\n{}\r\n", []any{"message", "wb:room:a", "{}"}, ""},
+		{"nested", "*2\r\n:1\r\n*1\r\n+x\r\n", []any{int64(1), []any{"x"}}, ""},
+		{"short", "+\n", nil, "redis: short reply"},
+		{"unknown type", "?x\r\n", nil, "redis: unknown reply"},
+		{"truncated bulk", "$5\r\nhe", nil, "EOF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readReply(bufio.NewReader(strings.NewReader(tt.in)))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		writeCommand(client, "PUBLISH", "wb:room:a", "x\r\ny")
+		client.Close()
+	}()
+
+	// the server side parses a command as an array of bulk strings
+	got, err := readReply(bufio.NewReader(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []any{"PUBLISH", "wb:room:a", "x\r\ny"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
+
+// newTestRedis connects to REDIS_ADDR, a real server or any local stand-in
+func newTestRedis(t *testing.T) *Redis {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	r, err := NewRedis("redis://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// keys outlive the test on the server, so every run gets its own room
+func testRoom(name string) string {
+	return fmt.Sprintf("test-%s-%d", name, time.Now().UnixNano())
+}
+
+func TestRedisSharedClock(t *testing.T) {
+	a, b := newTestRedis(t), newTestRedis(t)
+	roomID := testRoom("clock")
+
+	if clock, err := a.CurrentClock(roomID); err != nil || clock != 0 {
+		t.Fatalf("fresh room at %d (%v), want 0", clock, err)
+	}
+
+	// the first instance to load the room brings its db clock as the floor
+	clock, err := a.NextClock(roomID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clock != 11 {
+		t.Fatalf("first clock %d, want 11", clock)
+	}
+	// a stale floor from the other instance does not go backwards
+	if clock, _ = b.NextClock(roomID, 3); clock != 12 {
+		t.Fatalf("clock %d after a lower floor, want 12", clock)
+	}
+
+	const each = 100
+	var mu sync.Mutex
+	var got []int64
+
+	var wg sync.WaitGroup
+	for _, r := range []*Redis{a, b, a, b} {
+		wg.Add(1)
+		go func(r *Redis) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				clock, err := r.NextClock(roomID, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				got = append(got, clock)
+				mu.Unlock()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	// both instances share one counter, every clock handed out once
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	for i, clock := range got {
+		if clock != int64(13+i) {
+			t.Fatalf("clock %d at %d, want %d", clock, i, 13+i)
+		}
+	}
+
+	last := int64(12 + 4*each)
+	for _, r := range []*Redis{a, b} {
+		if clock, err := r.CurrentClock(roomID); err != nil || clock != last {
+			t.Fatalf("current clock %d (%v), want %d", clock, err, last)
+		}
+	}
+}
+
+// inbox collects what one subscriber gets
+type inbox struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (in *inbox) add(data []byte) {
+	in.mu.Lock()
+	in.msgs = append(in.msgs, string(data))
+	in.mu.Unlock()
+}
+
+func (in *inbox) count(msg string) int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	n := 0
+	for _, m := range in.msgs {
+		if m == msg {
+			n++
+		}
+	}
+	return n
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedisFanOut(t *testing.T) {
+	a, b := newTestRedis(t), newTestRedis(t)
+	roomID := testRoom("fanout")
+
+	var inA, inB, other inbox
+	unsubA, err := a.Subscribe(roomID, inA.add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe(roomID, inB.add); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Subscribe(roomID+"-other", other.add); err != nil {
+		t.Fatal(err)
+	}
+
+	// subscriber conns come up in the background
+	waitFor(t, "subscriptions", func() bool {
+		a.Publish(roomID, []byte("ready"))
+		time.Sleep(20 * time.Millisecond)
+		return inA.count("ready") > 0 && inB.count("ready") > 0
+	})
+
+	const each = 50
+	for i := 0; i < each; i++ {
+		if err := a.Publish(roomID, []byte("from-a")); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Publish(roomID, []byte("from-b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every instance gets every message, its own included
+	for name, in := range map[string]*inbox{"a": &inA, "b": &inB} {
+		waitFor(t, name+" messages", func() bool {
+			return in.count("from-a") == each && in.count("from-b") == each
+		})
+	}
+	if n := other.count("from-a") + other.count("from-b"); n != 0 {
+		t.Fatalf("other room got %d messages", n)
+	}
+
+	// after unsubscribing a stops getting the room
+	unsubA()
+	before := inA.count("late")
+	b.Publish(roomID, []byte("late"))
+	waitFor(t, "late message on b", func() bool { return inB.count("late") == 1 })
+	time.Sleep(50 * time.Millisecond)
+	if inA.count("late") != before {
+		t.Fatal("unsubscribed instance still got messages")
+	}
+}
@@ -6,4 +6,8 @@ const (
 	ContextUserIDKey   contextKey = "userId"
 	ContextUserNameKey contextKey = "userName"
 	ContextUserPicKey  contextKey = "userProfilePic"
+
+	// set by middleware.RequireRoomRole
+	ContextRoomIDKey   contextKey = "roomId"
+	ContextRoomRoleKey contextKey = "roomRole"
 )
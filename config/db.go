@@ -2,6 +2,7 @@ package config
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type Event struct {
@@ -29,6 +30,23 @@ type RoomEvent struct {
 	Now    int64  `json:"now"`
 	Public int8   `json:"public"`
 	Role   Role   `json:"role"`
+
+	Anonymous int8 `json:"anonymous,omitempty"` // set-anonymous only
+
+	Thumbnail string `json:"thumbnail,omitempty"` // listing only
+
+	Result chan error `json:"-"` // create and set-anonymous, nil does not wait
+}
+
+// AuditEvent is one row of room_audit. Action is "create", "join",
+// "add-user" or "invite", Actor is who did it and UserID who it happened to.
+type AuditEvent struct {
+	RoomID  string `json:"roomId"`
+	ActorID string `json:"actorId"`
+	UserID  string `json:"userId"`
+	Action  string `json:"action"`
+	Role    Role   `json:"role"`
+	Now     int64  `json:"now"`
 }
 
 type UserEvent struct {
@@ -54,6 +72,106 @@ type LayerEvent struct {
 	Name       string
 	Public     int
 	Now        int64
-	Result     chan error
-	LayerIndex chan int64
+	Result     chan error `json:"-"`
+	LayerIndex chan int64 `json:"-"`
+}
+
+type Snapshot struct {
+	RoomID    string             `json:"roomId"`
+	Layer     int64              `json:"layer"`
+	Seq       int64              `json:"seq"`   // last events seq covered
+	Clock     int64              `json:"clock"` // room clock at snapshot time
+	Strokes   []Event            `json:"strokes"`
+	Doms      []DomObjectNetwork `json:"doms"`
+	CreatedAt int64              `json:"ts"`
+	Compacted bool               `json:"compacted,omitempty"` // events up to Seq were pruned
+}
+
+type SnapshotEvent struct {
+	RoomID  string
+	Layer   int64
+	Compact bool
+	Result  chan error `json:"-"`
+}
+
+type ImportEvent struct {
+	Archive *RoomArchive // already rewritten for the new room
+	Result  chan error   `json:"-"`
+}
+
+// PermissionsEvent replaces the overrides of a room
+type PermissionsEvent struct {
+	RoomID      string      `json:"roomId"`
+	Permissions Permissions `json:"permissions"`
+	Result      chan error  `json:"-"`
+}
+
+type Invite struct {
+	ID        string `json:"id"`
+	RoomID    string `json:"roomId"`
+	Role      Role   `json:"role"`
+	CreatedBy string `json:"createdBy"`
+	MaxUses   int    `json:"maxUses"` // 0 is unlimited
+	Uses      int    `json:"uses"`
+	Revoked   bool   `json:"revoked"`
+	ExpiresAt int64  `json:"expiresAt"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// InviteEvent creates (Invite), revokes (Invite.ID and RoomID) or redeems
+// (Invite.ID for UserID) an invite, Role gets the role after a redeem
+type InviteEvent struct {
+	Invite Invite
+	UserID string
+	Result chan error `json:"-"`
+	Role   chan Role  `json:"-"`
+}
+
+type BackupConfig struct {
+	Bucket   string
+	Prefix   string        // key prefix, e.g. "backups/"
+	Interval time.Duration // 0 disables scheduled backups
+	Keep     int           // newest backups kept, 0 keeps all
+}
+
+// RoomArchive is a portable copy of one room, see db.ExportRoom. Version is
+// bumped whenever a field changes meaning.
+type RoomArchive struct {
+	Version    int                `json:"version"`
+	ExportedAt int64              `json:"exportedAt"`
+	Room       ArchiveRoom        `json:"room"`
+	Layers     []Layer            `json:"layers"`
+	LayerUsers []ArchiveLayerUser `json:"layerUsers"`
+	Members    []ArchiveMember    `json:"members"`
+	Events     []ArchiveEvent     `json:"events"`    // write order
+	Doms       []DomEvent         `json:"doms"`      // active only
+	Snapshots  []Snapshot         `json:"snapshots"` // compaction may have pruned events they cover
+	ObjectKeys []string           `json:"objectKeys"`
+
+	Permissions Permissions `json:"permissions,omitempty"` // room overrides
+}
+
+type ArchiveRoom struct {
+	RoomID    string `json:"roomId"`
+	OwnerID   string `json:"ownerId"`
+	Public    int8   `json:"public"`
+	Anonymous int8   `json:"anonymous,omitempty"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// ArchiveEvent keeps seq so snapshot cuts can be remapped on import
+type ArchiveEvent struct {
+	Event
+	Seq int64 `json:"seq"`
+}
+
+type ArchiveLayerUser struct {
+	Layer  int64  `json:"layer"`
+	UserID string `json:"userId"`
+}
+
+type ArchiveMember struct {
+	UserID   string `json:"userId"`
+	Role     Role   `json:"role"`
+	JoinedAt int64  `json:"joinedAt"`
 }
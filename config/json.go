@@ -1,8 +1,9 @@
 package config
 
 type NetworkMsg struct {
-	Operation string `json:"operation"`
-	ID        string `json:"id"`
+	Operation string   `json:"operation"`
+	ID        string   `json:"id"`
+	IDs       []string `json:"ids,omitempty"` // batch ops (stroke-remove)
 
 	// stroke
 	Stroke *StrokeObjectInterface `json:"stroke,omitempty"`
@@ -17,6 +18,17 @@ type NetworkMsg struct {
 	ClientData *ClientData `json:"clientData,omitempty"`
 	Areas      []Area      `json:"areas,omitempty"`
 	Layer      *Layer      `json:"layer,omitempty"`
+
+	// resume
+	Since  *int64 `json:"since,omitempty"`
+	Resync bool   `json:"resync,omitempty"`
+
+	// *-denied, the lowest role allowed to send the operation
+	Role *Role `json:"role,omitempty"`
+
+	// history-seek, a clock or a unix ms timestamp
+	To *int64 `json:"to,omitempty"`
+	At *int64 `json:"at,omitempty"`
 }
 
 type EventMeta struct {
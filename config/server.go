@@ -1,5 +1,7 @@
 package config
 
+import "strings"
+
 type ServerMsg struct {
 	Clock   int64      `json:"clock"`
 	Payload NetworkMsg `json:"payload"`
@@ -13,3 +15,74 @@ const (
 	RoleModerator             // 2
 	RoleOwner                 // 3
 )
+
+// Permissions maps a ws operation to the lowest room role that may send it.
+// A key is an operation, a family like "dom-*" or "*" for everything else,
+// the most specific key wins.
+type Permissions map[string]Role
+
+// Operations are the ws operations a client can send
+var Operations = []string{
+	"stroke-start", "stroke-update", "stroke-end", "stroke-add", "stroke-remove",
+	"dom-add", "dom-lock", "dom-unlock", "dom-transform", "dom-payload", "dom-remove",
+	"undo", "redo",
+	"cursor-update", "change-layer", "resume", "history-seek",
+}
+
+// ViewerOperations are all an anonymous viewer may send, whatever the room
+// matrix says. They only change what the viewer itself is shown.
+var ViewerOperations = []string{"change-layer", "resume", "history-seek"}
+
+// DefaultPermissions applies to every room, owners override single keys.
+// Guests can look around but not touch the board.
+var DefaultPermissions = Permissions{
+	"*":             RoleMember,
+	"stroke-*":      RoleMember,
+	"dom-*":         RoleMember,
+	"cursor-update": RoleGuest,
+	"change-layer":  RoleGuest,
+	"resume":        RoleGuest,
+	"history-seek":  RoleGuest,
+}
+
+// Required is the lowest role allowed to send op
+func (p Permissions) Required(op string) Role {
+	if r, ok := p[op]; ok {
+		return r
+	}
+	if family, _, ok := strings.Cut(op, "-"); ok {
+		if r, ok := p[family+"-*"]; ok {
+			return r
+		}
+	}
+	if r, ok := p["*"]; ok {
+		return r
+	}
+	return RoleOwner
+}
+
+// With returns the defaults with overrides written over them
+func (p Permissions) With(overrides Permissions) Permissions {
+	out := make(Permissions, len(p)+len(overrides))
+	for k, r := range p {
+		out[k] = r
+	}
+	for k, r := range overrides {
+		out[k] = r
+	}
+	return out
+}
+
+// ValidPermissionKey is "*", an operation or the family of one
+func ValidPermissionKey(key string) bool {
+	if key == "*" {
+		return true
+	}
+	for _, op := range Operations {
+		family, _, _ := strings.Cut(op, "-")
+		if key == op || key == family+"-*" {
+			return true
+		}
+	}
+	return false
+}
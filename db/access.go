@@ -0,0 +1,136 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// AdminRole is the global users_data.role that acts as owner in every room
+var AdminRole = int(config.RoleOwner)
+
+// RoomAccess is what decides the role of a user in a room, read in one go
+type RoomAccess struct {
+	Exists     bool
+	Public     bool
+	Anonymous  bool  // rooms.anonymous, only counts on public rooms
+	Owner      bool  // rooms.owner_id
+	RoomRole   int64 // users_rooms.role, -1 when not a member
+	GlobalRole int   // users_data.role
+}
+
+// Role is the effective room role: admins and the room owner are owners,
+// members have their users_rooms role and anyone else is a guest of a
+// public room. ok is false when the user has no access at all.
+func (a RoomAccess) Role() (config.Role, bool) {
+	switch {
+	case !a.Exists:
+		return 0, false
+	case a.GlobalRole >= AdminRole || a.Owner:
+		return config.RoleOwner, true
+	case a.RoomRole >= 0:
+		return config.IntToRole(int(a.RoomRole)), true
+	case a.Public:
+		return config.RoleGuest, true
+	}
+	return 0, false
+}
+
+// CanView is true for members, admins and anyone on a public room
+func (a RoomAccess) CanView() bool {
+	_, ok := a.Role()
+	return ok
+}
+
+// CanEdit is true from RoleMember up, the ws permission matrix narrows it
+// per operation
+func (a RoomAccess) CanEdit() bool {
+	role, ok := a.Role()
+	return ok && role >= config.RoleMember
+}
+
+func (s *sqlStore) GetRoomAccess(roomId string, userId string) (RoomAccess, error) {
+	var ownerID string
+	var public, anonymous int
+	a := RoomAccess{RoomRole: -1}
+
+	err := s.QueryRow(`
+		SELECT
+			r.owner_id,
+			r.public,
+			r.anonymous,
+			COALESCE(ur.role, -1),
+			COALESCE(ud.role, 0)
+		FROM rooms r
+		LEFT JOIN users_rooms ur ON ur.room_id = r.room_id AND ur.user_id = ?
+		LEFT JOIN users_data ud ON ud.user_id = ?
+		WHERE r.room_id = ?
+	`, userId, userId, roomId).Scan(&ownerID, &public, &anonymous, &a.RoomRole, &a.GlobalRole)
+
+	if err == sql.ErrNoRows {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+
+	a.Exists = true
+	a.Public = public == 1
+	a.Anonymous = a.Public && anonymous == 1
+	a.Owner = ownerID == userId
+	return a, nil
+}
+
+// SetRoomAnonymous lets viewers without an account watch the room over the
+// ws. The flag is kept on private rooms but only applies while the room is
+// public.
+func SetRoomAnonymous(roomId string, anonymous bool) error {
+	if W == nil {
+		return fmt.Errorf("writer not initialized")
+	}
+
+	var a int8
+	if anonymous {
+		a = 1
+	}
+
+	result := make(chan error, 1)
+	err := W.enqueue(DbJob{
+		Type: OpRoomAnonymous,
+		Room: config.RoomEvent{
+			RoomID:    roomId,
+			Anonymous: a,
+			Result:    result,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return <-result
+}
+
+func (w *Writer) setRoomAnonymous(j config.RoomEvent) error {
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE rooms SET anonymous = ?
+		WHERE room_id = ?
+	`, j.Anonymous, j.RoomID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrRoomNotFound
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+func TestRoomAccess(t *testing.T) {
+	tests := []struct {
+		name   string
+		access RoomAccess
+		role   config.Role
+		view   bool
+		edit   bool
+	}{
+		{"no room", RoomAccess{RoomRole: -1, GlobalRole: AdminRole}, 0, false, false},
+		{"private stranger", RoomAccess{Exists: true, RoomRole: -1}, 0, false, false},
+		{"public stranger", RoomAccess{Exists: true, Public: true, RoomRole: -1}, config.RoleGuest, true, false},
+		{"guest member", RoomAccess{Exists: true, RoomRole: int64(config.RoleGuest)}, config.RoleGuest, true, false},
+		{"member", RoomAccess{Exists: true, RoomRole: int64(config.RoleMember)}, config.RoleMember, true, true},
+		{"owner", RoomAccess{Exists: true, Owner: true, RoomRole: -1}, config.RoleOwner, true, true},
+		{"admin", RoomAccess{Exists: true, RoomRole: -1, GlobalRole: AdminRole}, config.RoleOwner, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if role, _ := tt.access.Role(); role != tt.role {
+				t.Fatalf("role %d, want %d", role, tt.role)
+			}
+			if got := tt.access.CanView(); got != tt.view {
+				t.Fatalf("CanView %v, want %v", got, tt.view)
+			}
+			if got := tt.access.CanEdit(); got != tt.edit {
+				t.Fatalf("CanEdit %v, want %v", got, tt.edit)
+			}
+		})
+	}
+}
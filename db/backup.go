@@ -0,0 +1,190 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// Backuper is implemented by stores that can write a consistent copy of
+// themselves while serving traffic.
+type Backuper interface {
+	BackupTo(path string) error
+}
+
+// BackupTo writes a compacted, consistent copy of the db to path. It runs
+// in a read transaction, so the writer keeps going (WAL).
+func (s *SQLiteStore) BackupTo(path string) error {
+	_, err := s.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// VerifySQLite runs an integrity check on a standalone sqlite file
+func VerifySQLite(path string) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return err
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check: %s", result)
+	}
+	return nil
+}
+
+// RewindSQLite drops everything after clock from a standalone sqlite file
+// (a restored backup, never the live db). Strokes come back from the event
+// log; dom objects touched after clock are rebuilt from the latest snapshot
+// plus their dom events, payload edits are not evented and keep the
+// payload of the dom-add.
+func RewindSQLite(path string, clock int64) error {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	s := &sqlStore{db: db, d: sqliteDialect}
+	defer s.Close()
+
+	// older backups need the current schema for the queries below
+	if _, err := s.Migrate(false); err != nil {
+		return err
+	}
+
+	tx, err := s.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// compaction dropped the events a rewind would need
+	var compacted int64
+	err = tx.QueryRow(`
+		SELECT COALESCE(MAX(clock), 0) FROM snapshots WHERE compacted = 1
+	`).Scan(&compacted)
+	if err != nil {
+		return err
+	}
+	if clock < compacted {
+		return fmt.Errorf("events up to clock %d were compacted, can not rewind to %d", compacted, clock)
+	}
+
+	type domRef struct {
+		roomID string
+		id     string
+		layer  int64
+	}
+	var touched []domRef
+
+	rows, err := tx.Query(`
+		SELECT DISTINCT room_id, entity_id, layer
+		FROM events
+		WHERE id > ? AND op IN ('dom-add', 'dom-transform', 'dom-remove')
+	`, clock)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var r domRef
+		if err := rows.Scan(&r.roomID, &r.id, &r.layer); err != nil {
+			rows.Close()
+			return err
+		}
+		touched = append(touched, r)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM events WHERE id > ?`, clock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM snapshots WHERE clock > ?`, clock); err != nil {
+		return err
+	}
+
+	for _, r := range touched {
+		if err := rewindDom(tx, r.roomID, r.id, r.layer); err != nil {
+			return fmt.Errorf("rewind dom %s: %w", r.id, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// runs after events past the target clock are gone
+func rewindDom(tx *storeTx, roomID, id string, layer int64) error {
+	var base []config.DomObjectNetwork
+	var from int64
+
+	snap, err := latestSnapshot(tx, roomID, layer)
+	if err != nil {
+		return err
+	}
+	if snap != nil {
+		from = snap.Seq
+		for _, d := range snap.Doms {
+			if d.ID == id {
+				base = append(base, d)
+			}
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT id, room_id, user_id, entity_id, op, payload, layer, created_at
+		FROM events
+		WHERE room_id = ? AND entity_id = ? AND seq > ?
+		AND op IN ('dom-add', 'dom-transform', 'dom-remove')
+		ORDER BY seq ASC
+	`, roomID, id, from)
+	if err != nil {
+		return err
+	}
+
+	var events []config.Event
+	for rows.Next() {
+		var e config.Event
+		if err := rows.Scan(
+			&e.ID, &e.RoomID, &e.UserID, &e.EntityID, &e.Op, &e.Payload, &e.LayerIndex, &e.CreatedAt,
+		); err != nil {
+			rows.Close()
+			return err
+		}
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	doms := ApplyDomEvents(base, events)
+	if len(doms) == 0 {
+		_, err = tx.Exec(`
+			UPDATE dom_objects SET is_removed = 1
+			WHERE id = ? AND room_id = ?
+		`, id, roomID)
+		return err
+	}
+	dom := doms[0]
+
+	_, err = tx.Exec(`
+		UPDATE dom_objects
+		SET
+			kind = ?,
+			x = ?, y = ?, rot = ?, w = ?, h = ?,
+			payload = ?,
+			layer = ?,
+			is_removed = 0
+		WHERE id = ? AND room_id = ?
+	`,
+		dom.Kind,
+		dom.Transform.X, dom.Transform.Y, dom.Transform.Rot, dom.Transform.W, dom.Transform.H,
+		dom.Payload,
+		dom.LayerIndex,
+		id, roomID,
+	)
+	return err
+}
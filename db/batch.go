@@ -0,0 +1,376 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+var (
+	// most jobs committed in one transaction
+	BatchSize = 256
+	// how long the writer waits for more jobs before committing a batch
+	BatchWindow = 5 * time.Millisecond
+)
+
+// pendingJob keeps the seq an event was given when it was dequeued, so a
+// retried batch writes the same order.
+type pendingJob struct {
+	job DbJob
+	seq int64
+}
+
+// batchable jobs are single statements; the rest run their own
+// transaction and act as a barrier, which keeps queue order (and so order
+// per room) intact.
+func batchable(job DbJob) bool {
+	switch job.Type {
+	case OpWriteEvent, OpDomCreate, OpDomTransform, OpDomPayload,
+		OpDomRemove, OpRoomEditUser, OpUser, OpAudit:
+		return true
+	}
+	return false
+}
+
+func jobName(t int) string {
+	switch t {
+	case OpWriteEvent:
+		return "Event"
+	case OpDomCreate:
+		return "Dom Create"
+	case OpDomTransform:
+		return "Dom Transform"
+	case OpDomPayload:
+		return "Dom Payload"
+	case OpDomRemove:
+		return "Dom Remove"
+	case OpRoomCreate:
+		return "Room Create"
+	case OpRoomEditUser:
+		return "Join Room"
+	case OpUser:
+		return "Edit User"
+	case OpLayerCreate:
+		return "Layer Create"
+	case OpSnapshot:
+		return "Snapshot"
+	case OpRoomImport:
+		return "Room Import"
+	case OpRoomPermissions:
+		return "Room Permissions"
+	case OpAudit:
+		return "Audit"
+	case OpInviteCreate:
+		return "Invite Create"
+	case OpInviteRevoke:
+		return "Invite Revoke"
+	case OpInviteRedeem:
+		return "Invite Redeem"
+	case OpRoomAnonymous:
+		return "Room Anonymous"
+	case OpFlush:
+		return "Flush"
+	}
+	return "Unknown"
+}
+
+func (w *Writer) writerLoop() {
+	st, err := w.store.prepare()
+	if err != nil {
+		panic(err)
+	}
+	defer st.Close()
+
+	batch := make([]pendingJob, 0, BatchSize)
+	var barrier *DbJob
+
+	for job := range w.opCh {
+		batch = batch[:0]
+		barrier = nil
+
+		if !batchable(job) {
+			w.runOwn(job)
+			continue
+		}
+		batch = append(batch, w.pending(job))
+
+		// collect until full, the window closes or a barrier shows up
+		window := time.NewTimer(BatchWindow)
+	collect:
+		for len(batch) < BatchSize {
+			select {
+			case next, ok := <-w.opCh:
+				if !ok {
+					break collect
+				}
+				if !batchable(next) {
+					barrier = &next
+					break collect
+				}
+				batch = append(batch, w.pending(next))
+			case <-window.C:
+				break collect
+			}
+		}
+		window.Stop()
+
+		w.commitBatch(st, batch)
+
+		if barrier != nil {
+			w.runOwn(*barrier)
+		}
+	}
+}
+
+func (w *Writer) pending(job DbJob) pendingJob {
+	p := pendingJob{job: job}
+	if job.Type == OpWriteEvent {
+		w.seq++
+		p.seq = w.seq
+	}
+	return p
+}
+
+// commitBatch writes the batch in one transaction. If a statement fails
+// for a reason other than a busy db, the batch is replayed job by job so
+// one bad row does not take the others with it.
+func (w *Writer) commitBatch(st *stmts, batch []pendingJob) {
+	err := w.withRetry(func() error {
+		tx, err := w.store.begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		txSt := st.in(tx)
+		for _, p := range batch {
+			if err := txSt.exec(p); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+
+	if err == nil {
+		for _, p := range batch {
+			w.done(p.job, jobName(p.job.Type), nil)
+		}
+		return
+	}
+
+	if len(batch) == 1 {
+		w.done(batch[0].job, jobName(batch[0].job.Type), err)
+		return
+	}
+
+	for _, p := range batch {
+		err := w.withRetry(func() error {
+			return st.exec(p)
+		})
+		w.done(p.job, jobName(p.job.Type), err)
+	}
+}
+
+// runOwn runs a job that opens its own transaction and may report back to
+// a waiting caller.
+func (w *Writer) runOwn(job DbJob) {
+	switch job.Type {
+	case OpRoomCreate:
+		err := w.withRetry(func() error {
+			return w.createRoom(job.Room)
+		})
+		w.done(job, jobName(job.Type), err)
+		if job.Room.Result != nil {
+			job.Room.Result <- err
+		}
+
+	case OpLayerCreate:
+		j := job.Layer
+
+		var nextLayer int64
+		err := w.withRetry(func() error {
+			var err error
+			nextLayer, err = w.createLayer(j)
+			return err
+		})
+		w.done(job, jobName(job.Type), err)
+
+		j.Result <- err
+		if err == nil {
+			j.LayerIndex <- nextLayer // ← Send back the created layer index
+		}
+
+	case OpSnapshot:
+		j := job.Snapshot
+		err := w.withRetry(func() error {
+			return w.buildSnapshot(j)
+		})
+		w.done(job, jobName(job.Type), err)
+		j.Result <- err
+
+	case OpRoomImport:
+		j := job.Import
+		err := w.withRetry(func() error {
+			return w.importRoom(j.Archive)
+		})
+		w.done(job, jobName(job.Type), err)
+		j.Result <- err
+
+	case OpRoomPermissions:
+		j := job.Permissions
+		err := w.withRetry(func() error {
+			return w.setRoomPermissions(j)
+		})
+		w.done(job, jobName(job.Type), err)
+		j.Result <- err
+
+	case OpRoomAnonymous:
+		j := job.Room
+		err := w.withRetry(func() error {
+			return w.setRoomAnonymous(j)
+		})
+		if !errors.Is(err, ErrRoomNotFound) {
+			w.done(job, jobName(job.Type), err)
+		}
+		j.Result <- err
+
+	case OpInviteCreate, OpInviteRevoke:
+		j := job.Invite
+		err := w.withRetry(func() error {
+			if job.Type == OpInviteCreate {
+				return w.createInvite(j)
+			}
+			return w.revokeInvite(j)
+		})
+		if !refused(err) {
+			w.done(job, jobName(job.Type), err)
+		}
+		j.Result <- err
+
+	case OpInviteRedeem:
+		j := job.Invite
+
+		var role config.Role
+		err := w.withRetry(func() error {
+			var err error
+			role, err = w.redeemInvite(j)
+			return err
+		})
+		if !refused(err) {
+			w.done(job, jobName(job.Type), err)
+		}
+
+		j.Result <- err
+		if err == nil {
+			j.Role <- role
+		}
+
+	case OpFlush:
+		close(job.Flushed)
+	}
+}
+
+func (s *stmts) in(t *storeTx) *stmts {
+	return &stmts{
+		event:        t.tx.Stmt(s.event),
+		domCreate:    t.tx.Stmt(s.domCreate),
+		domTransform: t.tx.Stmt(s.domTransform),
+		domPayload:   t.tx.Stmt(s.domPayload),
+		domRemove:    t.tx.Stmt(s.domRemove),
+		editRoom:     t.tx.Stmt(s.editRoom),
+		user:         t.tx.Stmt(s.user),
+		audit:        t.tx.Stmt(s.audit),
+	}
+}
+
+func (s *stmts) Close() {
+	for _, stmt := range []*sql.Stmt{
+		s.event, s.domCreate, s.domTransform, s.domPayload,
+		s.domRemove, s.editRoom, s.user, s.audit,
+	} {
+		stmt.Close()
+	}
+}
+
+func (s *stmts) exec(p pendingJob) error {
+	job := p.job
+	var err error
+
+	switch job.Type {
+	case OpWriteEvent:
+		e := job.Event
+		_, err = s.event.Exec(
+			e.ID, e.RoomID, e.UserID, e.EntityID,
+			e.Op, e.Payload, e.LayerIndex, e.CreatedAt, p.seq,
+		)
+
+	case OpDomCreate:
+		d := job.Dom
+		_, err = s.domCreate.Exec(
+			d.ID, d.RoomID, d.UserID, d.Kind,
+			d.Transform.X, d.Transform.Y,
+			d.Transform.Rot, d.Transform.W, d.Transform.H,
+			d.Payload, d.LayerIndex,
+			d.CreatedAt, d.UpdatedAt,
+		)
+
+	case OpDomTransform:
+		d := job.Dom
+		_, err = s.domTransform.Exec(
+			d.Transform.X, d.Transform.Y,
+			d.Transform.Rot, d.Transform.W, d.Transform.H,
+			d.UpdatedAt,
+			d.ID, d.RoomID,
+		)
+
+	case OpDomPayload:
+		d := job.Dom
+		_, err = s.domPayload.Exec(
+			d.Payload,
+			d.UpdatedAt,
+			d.ID, d.RoomID,
+		)
+
+	case OpDomRemove:
+		_, err = s.domRemove.Exec(
+			time.Now().UnixMilli(),
+			job.RemoveID,
+			job.RemoveRoomID,
+		)
+
+	case OpRoomEditUser:
+		j := job.Room
+		_, err = s.editRoom.Exec(
+			j.UserID,
+			j.RoomID,
+			int(j.Role),
+			time.Now().UnixMilli(),
+		)
+
+	case OpUser:
+		j := job.User
+		_, err = s.user.Exec(
+			j.UserID,
+			int(j.Role),
+			j.Name,
+			j.GivenName,
+			j.Email,
+			j.Created_at,
+		)
+
+	case OpAudit:
+		j := job.Audit
+		_, err = s.audit.Exec(
+			j.RoomID,
+			j.ActorID,
+			j.UserID,
+			j.Action,
+			int(j.Role),
+			j.Now,
+		)
+	}
+
+	return err
+}
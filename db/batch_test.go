@@ -0,0 +1,80 @@
+package db
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+var benchPayload = json.RawMessage(`{"id":"s","kind":"stroke","color":"#000","points":[{"x":1,"y":2},{"x":3,"y":4}]}`)
+
+func benchEvent(i int) config.Event {
+	return config.Event{
+		EventMeta: config.EventMeta{ID: int64(i + 1), RoomID: "bench", UserID: "u"},
+		EntityID:  "s" + strconv.Itoa(i),
+		Op:        "stroke-add",
+		Payload:   benchPayload,
+		CreatedAt: time.Now().UnixMilli(),
+	}
+}
+
+// BenchmarkBatchWrite goes through the writer, which commits up to
+// BatchSize jobs per transaction
+func BenchmarkBatchWrite(b *testing.B) {
+	OpenTestStore(b)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		WriteEvent(benchEvent(i))
+	}
+	if err := Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkRowWrite is the old writer loop: one insert and so one
+// implicit transaction per event
+func BenchmarkRowWrite(b *testing.B) {
+	s := OpenTestStore(b).(*SQLiteStore)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		e := benchEvent(i)
+		_, err := s.Exec(`
+			INSERT INTO events
+			(id, room_id, user_id, entity_id, op, payload, layer, created_at, seq)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, e.ID, e.RoomID, e.UserID, e.EntityID, e.Op, string(e.Payload), e.LayerIndex, e.CreatedAt, e.ID)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBatchWriteKeepsOrder(t *testing.T) {
+	OpenTestStore(t)
+
+	const n = 3 * 256
+	for i := 0; i < n; i++ {
+		WriteEvent(benchEvent(i))
+	}
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := GetEvent("bench", "0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != n {
+		t.Fatalf("%d events written, want %d", len(events), n)
+	}
+	for i, e := range events {
+		if e.EntityID != "s"+strconv.Itoa(i) {
+			t.Fatalf("event %d is %s", i, e.EntityID)
+		}
+	}
+}
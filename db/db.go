@@ -3,10 +3,9 @@ package db
 import (
 	"database/sql"
 	"fmt"
+	"sync"
 	"time"
 
-	_ "modernc.org/sqlite"
-
 	"github.com/Tk21111/whiteboard_server/config"
 )
 
@@ -21,6 +20,15 @@ const (
 	OpRoomEditUser
 	OpUser
 	OpLayerCreate
+	OpSnapshot
+	OpRoomImport
+	OpRoomPermissions
+	OpAudit
+	OpInviteCreate
+	OpInviteRevoke
+	OpInviteRedeem
+	OpRoomAnonymous
+	OpFlush
 )
 
 type DbJob struct {
@@ -32,200 +40,79 @@ type DbJob struct {
 	Room         config.RoomEvent
 	User         config.UserEvent
 	Layer        config.LayerEvent
+	Snapshot     config.SnapshotEvent
+	Import       config.ImportEvent
+	Permissions  config.PermissionsEvent
+	Audit        config.AuditEvent
+	Invite       config.InviteEvent
+	Flushed      chan struct{} // OpFlush only
 }
 
 type Writer struct {
-	db   *sql.DB
-	opCh chan DbJob
+	store Store
+	opCh  chan DbJob
+
+	deadLetterPath string
+	dlMu           sync.Mutex
+
+	// write order of events, only touched by writerLoop
+	seq int64
 }
 
 var (
 	W *Writer
 )
 
-func NewWriter(dbPath string) {
-	db, err := sql.Open("sqlite", dbPath)
-	if err != nil {
-		panic(err)
-	}
-
-	if _, err := db.Exec(`
-        PRAGMA journal_mode = WAL;
-        PRAGMA synchronous = NORMAL;
-        PRAGMA busy_timeout = 5000; -- Wait 5s if db is locked
-    `); err != nil {
+// NewWriter migrates store and starts the write loop, failed jobs are
+// appended to deadLetterPath.
+func NewWriter(store Store, deadLetterPath string) {
+	if _, err := store.Migrate(false); err != nil {
 		panic(err)
 	}
 
-	// Create events table
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS events (
-            id INTEGER NOT NULL,
-            room_id TEXT NOT NULL,
-            user_id TEXT NOT NULL,
-            entity_id TEXT NOT NULL,
-            op TEXT NOT NULL,
-            payload BLOB NOT NULL,
-			layer INTEGER NOT NULL ,
-            created_at INTEGER NOT NULL
-        );
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-        CREATE INDEX IF NOT EXISTS idx_events_room_clock
-        ON events(room_id, id);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	// Create dom_objects table
-	_, err = db.Exec(`
-        CREATE TABLE IF NOT EXISTS dom_objects (
-            id TEXT PRIMARY KEY,
-            room_id TEXT NOT NULL,
-            user_id TEXT NOT NULL,
-            kind TEXT NOT NULL, 
-            x   REAL NOT NULL,
-            y   REAL NOT NULL,
-            rot REAL NOT NULL,
-            w   REAL NOT NULL,
-            h   REAL NOT NULL,
-			layer INTEGET NOT NULL ,
-			payload TEXT NOT NULL DEFAULT "",
-            is_removed INTEGER NOT NULL DEFAULT 0,
-
-            created_at INTEGER NOT NULL,
-            updated_at INTEGER NOT NULL
-        );
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	//room
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS rooms (
-			room_id TEXT PRIMARY KEY,
-			owner_id TEXT NOT NULL,
-			public INTEGER NOT NULL DEFAULT 1,
-			created_at INTEGER NOT NULL
-		);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS layers (
-		layer_index INTEGER NOT NULL,
-		room_id TEXT NOT NULL,
-		owner_id TEXT NOT NULL,
-		name TEXT NOT NULL DEFAULT "",
-		public INTEGER NOT NULL DEFAULT 0,
-		created_at INTEGER NOT NULL,
-
-		PRIMARY KEY (room_id, layer_index)
-	);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users_layers (
-		room_id TEXT NOT NULL,
-		layer_index INTEGER NOT NULL,
-		user_id TEXT NOT NULL,
-
-		PRIMARY KEY (room_id, layer_index, user_id),
-		FOREIGN KEY (room_id, layer_index)
-			REFERENCES layers(room_id, layer_index)
-			ON DELETE CASCADE
-	);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-		CREATE INDEX IF NOT EXISTS idx_users_layers_user
-		ON users_layers(user_id);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS users_data (
-		user_id TEXT PRIMARY KEY,
-		role INTEGER NOT NULL DEFAULT 0,
-
-		name TEXT NOT NULL DEFAULT "",
-		given_name TEXT NOT NULL DEFAULT "",
-		email TEXT NOT NULL DEFAULT "",
-
-		created_at INTEGER NOT NULL
-	);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-			CREATE TABLE IF NOT EXISTS users_rooms (
-			user_id TEXT NOT NULL,
-			room_id TEXT NOT NULL,
-			role INTEGER NOT NULL DEFAULT 0,
-			joined_at INTEGER NOT NULL,
-			PRIMARY KEY (user_id, room_id)
-		);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-        CREATE INDEX IF NOT EXISTS idx_dom_objects_room
-        ON dom_objects(room_id);
-    `)
-	if err != nil {
-		panic(err)
-	}
-
-	_, err = db.Exec(`
-        CREATE INDEX IF NOT EXISTS idx_dom_objects_room_active
-        ON dom_objects(room_id, is_removed);
-    `)
+	seq, err := store.maxSeq()
 	if err != nil {
 		panic(err)
 	}
 
 	W = &Writer{
-		db:   db,
-		opCh: make(chan DbJob, 10000),
+		store:          store,
+		opCh:           make(chan DbJob, 10000),
+		deadLetterPath: deadLetterPath,
+		seq:            seq,
 	}
 
 	go W.writerLoop()
 }
 
-func (w *Writer) writerLoop() {
+// stmts are prepared once and bound to each batch transaction
+type stmts struct {
+	event        *sql.Stmt
+	domCreate    *sql.Stmt
+	domTransform *sql.Stmt
+	domPayload   *sql.Stmt
+	domRemove    *sql.Stmt
+	editRoom     *sql.Stmt
+	user         *sql.Stmt
+	audit        *sql.Stmt
+}
+
+func (st *sqlStore) prepare() (*stmts, error) {
+	var err error
+	s := &stmts{}
+
 	// 1. Prepare Event Statement
-	stmtEvent, err := w.db.Prepare(`
+	s.event, err = st.Prepare(`
         INSERT INTO events
-        (id, room_id, user_id, entity_id, op, payload, layer,  created_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7 , $8)
+        (id, room_id, user_id, entity_id, op, payload, layer,  created_at, seq)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
     `)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer stmtEvent.Close()
 
 	// 2. Prepare Dom Upsert Statement
-	stmtDomCreate, err := w.db.Prepare(`
+	s.domCreate, err = st.Prepare(`
 		INSERT INTO dom_objects
 		(
 			id, room_id, user_id, kind,
@@ -234,13 +121,24 @@ func (w *Writer) writerLoop() {
 			created_at, updated_at
 		)
 		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? , ?)
+		ON CONFLICT(room_id, id)
+		DO UPDATE SET
+			kind = excluded.kind,
+			x = excluded.x,
+			y = excluded.y,
+			rot = excluded.rot,
+			w = excluded.w,
+			h = excluded.h,
+			payload = excluded.payload,
+			layer = excluded.layer,
+			is_removed = 0,
+			updated_at = excluded.updated_at
 	`)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer stmtDomCreate.Close()
 
-	stmtDomTransform, err := w.db.Prepare(`
+	s.domTransform, err = st.Prepare(`
 		UPDATE dom_objects
 		SET
 			x = ?,
@@ -255,11 +153,10 @@ func (w *Writer) writerLoop() {
 			AND is_removed = 0
 	`)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer stmtDomTransform.Close()
 
-	stmtDomPayload, err := w.db.Prepare(`
+	s.domPayload, err = st.Prepare(`
 		UPDATE dom_objects
 		SET
 			payload = ?,
@@ -270,12 +167,11 @@ func (w *Writer) writerLoop() {
 			AND is_removed = 0
 	`)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer stmtDomPayload.Close()
 
 	// 3. Prepare Dom Remove Statement
-	stmtRemove, err := w.db.Prepare(`
+	s.domRemove, err = st.Prepare(`
         UPDATE dom_objects
         SET
             is_removed = 1,
@@ -286,11 +182,10 @@ func (w *Writer) writerLoop() {
             AND is_removed = 0
     `)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer stmtRemove.Close()
 
-	stmtEditRoom, err := w.db.Prepare(`
+	s.editRoom, err = st.Prepare(`
 		INSERT INTO users_rooms (user_id, room_id, role, joined_at)
 		VALUES (?, ?, ?, ?)
 		ON CONFLICT(user_id, room_id)
@@ -298,11 +193,10 @@ func (w *Writer) writerLoop() {
 			role = excluded.role
 	`)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer stmtEditRoom.Close()
 
-	stmtUser, err := w.db.Prepare(`
+	s.user, err = st.Prepare(`
 		INSERT INTO users_data (
 			user_id,
 			role,
@@ -321,166 +215,84 @@ func (w *Writer) writerLoop() {
 	`)
 
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	s.audit, err = st.Prepare(`
+		INSERT INTO room_audit (room_id, actor_id, user_id, action, role, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (w *Writer) createRoom(j config.RoomEvent) error {
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO rooms (room_id, owner_id, public , created_at)
+		VALUES (?, ?, ?, ?)`,
+		j.RoomID, j.UserID, j.Public, j.Now,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO users_rooms (user_id, room_id, role, joined_at)
+		VALUES (?, ?, 3, ?)`,
+		j.UserID, j.RoomID, j.Now,
+	)
+	if err != nil {
+		return err
 	}
-	defer stmtUser.Close()
-
-	// --- Main Loop ---
-	for job := range w.opCh {
-		switch job.Type {
-
-		case OpWriteEvent:
-			e := job.Event
-			_, err := stmtEvent.Exec(
-				e.ID, e.RoomID, e.UserID, e.EntityID,
-				e.Op, e.Payload, e.LayerIndex, e.CreatedAt,
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Event): %v\n", err)
-			}
-
-		case OpDomCreate:
-			d := job.Dom
-			_, err := stmtDomCreate.Exec(
-				d.ID, d.RoomID, d.UserID, d.Kind,
-				d.Transform.X, d.Transform.Y,
-				d.Transform.Rot, d.Transform.W, d.Transform.H,
-				d.Payload, d.LayerIndex,
-				d.CreatedAt, d.UpdatedAt,
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Dom Create): %v\n", err)
-			}
-
-		case OpDomTransform:
-			d := job.Dom
-			_, err := stmtDomTransform.Exec(
-				d.Transform.X, d.Transform.Y,
-				d.Transform.Rot, d.Transform.W, d.Transform.H,
-				d.UpdatedAt,
-				d.ID, d.RoomID,
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Dom Transform): %v\n", err)
-			}
-
-		case OpDomPayload:
-			d := job.Dom
-			_, err := stmtDomPayload.Exec(
-				d.Payload,
-				d.UpdatedAt,
-				d.ID, d.RoomID,
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Dom Payload): %v\n", err)
-			}
-
-		case OpDomRemove:
-			_, err := stmtRemove.Exec(
-				time.Now().UnixMilli(),
-				job.RemoveID,
-				job.RemoveRoomID,
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Dom Remove): %v\n", err)
-			}
-		case OpRoomCreate:
-			j := job.Room
-
-			tx, err := w.db.Begin()
-			if err != nil {
-				break
-			}
-
-			_, err = tx.Exec(
-				`INSERT INTO rooms (room_id, owner_id, public , created_at)
-		 		VALUES (?, ?, ?, ?)`,
-				j.RoomID, j.UserID, j.Public, j.Now,
-			)
-			if err != nil {
-				tx.Rollback()
-				fmt.Println("room create")
-				fmt.Println(err)
-				break
-			}
-
-			_, err = tx.Exec(
-				`INSERT INTO users_rooms (user_id, room_id, role, joined_at)
-		 		VALUES (?, ?, 3, ?)`,
-				j.UserID, j.RoomID, j.Now,
-			)
-			if err != nil {
-				tx.Rollback()
-				break
-			}
-
-			_, err = tx.Exec(`
-					INSERT INTO layers (
-						room_id,
-						layer_index,
-						owner_id,
-						name,
-						public,
-						created_at
-					) VALUES (?, 0, ?, 'Base Layer', 1, ?)
-				`,
-				j.RoomID,
-				j.UserID,
-				j.Now,
-			)
-			if err != nil {
-				tx.Rollback()
-				break
-			}
-
-			err = tx.Commit()
-		case OpRoomEditUser:
-			j := job.Room
-			_, err := stmtEditRoom.Exec(
-				j.UserID,
-				j.RoomID,
-				int(j.Role),
-				time.Now().UnixMilli(),
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Join Room): %v\n", err)
-			}
-		case OpUser:
-			j := job.User
-			_, err := stmtUser.Exec(
-				j.UserID,
-				int(j.Role),
-				j.Name,
-				j.GivenName,
-				j.Email,
-				j.Created_at,
-			)
-			if err != nil {
-				fmt.Printf("DB Error (Edit User): %v\n", err)
-			}
-		case OpLayerCreate:
-			j := job.Layer
-
-			tx, err := w.db.Begin()
-			if err != nil {
-				j.Result <- err
-				break
-			}
-
-			var nextLayer int64 // ← Change to int64
-			err = tx.QueryRow(`
+
+	_, err = tx.Exec(`
+			INSERT INTO layers (
+				room_id,
+				layer_index,
+				owner_id,
+				name,
+				public,
+				created_at
+			) VALUES (?, 0, ?, 'Base Layer', 1, ?)
+		`,
+		j.RoomID,
+		j.UserID,
+		j.Now,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (w *Writer) createLayer(j config.LayerEvent) (int64, error) {
+	tx, err := w.store.begin()
+	if err != nil {
+		return -1, err
+	}
+	defer tx.Rollback()
+
+	var nextLayer int64
+	err = tx.QueryRow(`
 		SELECT COALESCE(MAX(layer_index), -1) + 1
 		FROM layers
 		WHERE room_id = ?
 	`, j.RoomID).Scan(&nextLayer)
+	if err != nil {
+		return -1, err
+	}
 
-			if err != nil {
-				tx.Rollback()
-				j.Result <- err
-				break
-			}
-
-			_, err = tx.Exec(`
+	_, err = tx.Exec(`
 		INSERT INTO layers (
 			room_id,
 			layer_index,
@@ -490,101 +302,82 @@ func (w *Writer) writerLoop() {
 			created_at
 		) VALUES (?, ?, ?, ?, ?, ?)
 	`,
-				j.RoomID,
-				nextLayer,
-				j.UserID,
-				j.Name,
-				j.Public,
-				j.Now,
-			)
-
-			if err != nil {
-				tx.Rollback()
-				j.Result <- err
-				break
-			}
-
-			// Owner always has access
-			_, err = tx.Exec(`
+		j.RoomID,
+		nextLayer,
+		j.UserID,
+		j.Name,
+		j.Public,
+		j.Now,
+	)
+	if err != nil {
+		return -1, err
+	}
+
+	// Owner always has access
+	_, err = tx.Exec(`
 		INSERT INTO users_layers (room_id, layer_index, user_id)
 		VALUES (?, ?, ?)
 	`,
-				j.RoomID,
-				nextLayer,
-				j.UserID,
-			)
-
-			if err != nil {
-				tx.Rollback()
-				j.Result <- err
-				break
-			}
-
-			err = tx.Commit()
-			j.Result <- err
-
-			if err == nil {
-				j.LayerIndex <- nextLayer // ← Send back the created layer index
-			}
-		}
+		j.RoomID,
+		nextLayer,
+		j.UserID,
+	)
+	if err != nil {
+		return -1, err
 	}
 
+	return nextLayer, tx.Commit()
 }
 
 // --- Public Write Methods ---
+// Writes wait at most EnqueueTimeout for queue space, anything that can not
+// be queued or written ends up in the dead-letter file (see writer.go).
 
 func WriteEvent(e config.Event) {
 	if W == nil {
 		return
 	}
-	select {
-	case W.opCh <- DbJob{Type: OpWriteEvent, Event: e}:
-	default:
-		// channel full
-	}
+	_ = W.enqueue(DbJob{Type: OpWriteEvent, Event: e})
 }
 
 func WriteDom(e config.DomEvent, op int) {
 	if W == nil {
 		return
 	}
-	// fmt.Println("ch writedom")
-	select {
-	case W.opCh <- DbJob{Type: op, Dom: e}:
-	default:
-		fmt.Println("fail ch writeDom")
-	}
+	_ = W.enqueue(DbJob{Type: op, Dom: e})
 }
 
 func RemoveDom(id, roomId string) {
 	if W == nil {
 		return
 	}
-	// Now asynchronous via channel
-	select {
-	case W.opCh <- DbJob{Type: OpDomRemove, RemoveID: id, RemoveRoomID: roomId}:
-	default:
-		fmt.Println("fail ch removeDom")
-	}
+	_ = W.enqueue(DbJob{Type: OpDomRemove, RemoveID: id, RemoveRoomID: roomId})
 }
 
 // crate and join
+// CreateRoom waits until the room is written, so it can be joined right away
 func CreateRoom(roomId, userId string, public int8, mainArea int64, subArea int64) error {
 	if W == nil {
 		return fmt.Errorf("writer not initialized")
 	}
 
-	W.opCh <- DbJob{
+	result := make(chan error, 1)
+
+	err := W.enqueue(DbJob{
 		Type: OpRoomCreate,
 		Room: config.RoomEvent{
 			RoomID: roomId,
 			UserID: userId,
 			Public: public,
 			Now:    time.Now().UnixMilli(),
+			Result: result,
 		},
+	})
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return <-result
 }
 
 func JoinRoom(roomId, userId string, role config.Role) error {
@@ -592,20 +385,32 @@ func JoinRoom(roomId, userId string, role config.Role) error {
 		return fmt.Errorf("writer not initialized")
 	}
 
-	select {
-	case W.opCh <- DbJob{
+	return W.enqueue(DbJob{
 		Type: OpRoomEditUser,
 		Room: config.RoomEvent{
 			RoomID: roomId,
 			UserID: userId,
 			Role:   role,
 		},
-	}:
-	default:
-		fmt.Println("fail ch joinRoom")
-	}
+	})
+}
 
-	return nil
+// Audit records a membership change in room_audit, queued behind it
+func Audit(roomId, actorId, userId, action string, role config.Role) {
+	if W == nil {
+		return
+	}
+	_ = W.enqueue(DbJob{
+		Type: OpAudit,
+		Audit: config.AuditEvent{
+			RoomID:  roomId,
+			ActorID: actorId,
+			UserID:  userId,
+			Action:  action,
+			Role:    role,
+			Now:     time.Now().UnixMilli(),
+		},
+	})
 }
 
 func CreateUser(
@@ -619,8 +424,7 @@ func CreateUser(
 		return fmt.Errorf("writer not initialized")
 	}
 
-	select {
-	case W.opCh <- DbJob{
+	return W.enqueue(DbJob{
 		Type: OpUser,
 		User: config.UserEvent{
 			UserID:     userId,
@@ -630,12 +434,7 @@ func CreateUser(
 			Email:      email,
 			Created_at: time.Now().Unix(),
 		},
-	}:
-	default:
-		fmt.Println("fail ch createUser")
-	}
-
-	return nil
+	})
 }
 
 func CreateLayer(roomId, userId, name string, public int) (int64, error) {
@@ -646,7 +445,7 @@ func CreateLayer(roomId, userId, name string, public int) (int64, error) {
 	result := make(chan error, 1)
 	layerIndex := make(chan int64, 1) // ← Add channel for layer index
 
-	W.opCh <- DbJob{
+	err := W.enqueue(DbJob{
 		Type: OpLayerCreate,
 		Layer: config.LayerEvent{
 			RoomID:     roomId,
@@ -657,9 +456,12 @@ func CreateLayer(roomId, userId, name string, public int) (int64, error) {
 			Result:     result,
 			LayerIndex: layerIndex, // ← Pass the channel
 		},
+	})
+	if err != nil {
+		return -1, err
 	}
 
-	err := <-result
+	err = <-result
 	if err != nil {
 		return -1, err
 	}
@@ -667,17 +469,25 @@ func CreateLayer(roomId, userId, name string, public int) (int64, error) {
 	return <-layerIndex, nil // ← Return the created layer index
 }
 
-// --- Read Methods (Unchanged, safe for concurrent read) ---
-
-func GetEvent(roomID string, id string, layer int) ([]config.Event, error) {
-	// ... (Same as your original code)
-	// Need to include the body here if you want a complete file copy-paste
-	// I will assume you keep the original implementation here as it was correct.
-	rows, err := W.db.Query(`
-        SELECT id, room_id, user_id, entity_id, op, payload, created_at
-        FROM events
-        WHERE room_id = ? AND id > ? AND op = 'stroke-add' AND layer = ?
-        ORDER BY id ASC
+// --- Read Methods (safe for concurrent read, exposed through Store) ---
+
+func (s *sqlStore) GetEvent(roomID string, id string, layer int) ([]config.Event, error) {
+	rows, err := s.Query(`
+        SELECT e.id, e.room_id, e.user_id, e.entity_id, e.op, e.payload, e.created_at
+        FROM events e
+        WHERE e.room_id = ? AND e.id > ? AND e.op = 'stroke-add' AND e.layer = ?
+        AND NOT EXISTS (
+            -- stroke was erased or undone after this add, on its own layer
+            -- like GetStrokeState
+            SELECT 1
+            FROM events r
+            WHERE r.room_id = e.room_id
+            AND r.layer = e.layer
+            AND r.entity_id = e.entity_id
+            AND r.op = 'stroke-remove'
+            AND r.id > e.id
+        )
+        ORDER BY e.id ASC
     `, roomID, id, layer)
 	if err != nil {
 		return nil, err
@@ -699,50 +509,77 @@ func GetEvent(roomID string, id string, layer int) ([]config.Event, error) {
 	return events, nil
 }
 
-func GetActiveDomObjects(roomID string, layer int64) ([]config.DomObjectNetwork, error) {
-	// ... (Same as your original code)
-	rows, err := W.db.Query(`
-        SELECT
-            id, kind, x, y, rot, w, h , payload , layer
-        FROM dom_objects
-        WHERE room_id = ?
-        AND is_removed = 0
-		AND layer = ?
-    `, roomID, layer)
+// GetRemovedSince returns stroke-remove and dom-remove events after clock id,
+// used when a client resumes and already holds older state.
+func (s *sqlStore) GetRemovedSince(roomID string, id int64, layer int64) ([]config.Event, error) {
+	rows, err := s.Query(`
+        SELECT id, room_id, user_id, entity_id, op, payload, created_at
+        FROM events
+        WHERE room_id = ? AND id > ? AND layer = ?
+        AND op IN ('stroke-remove', 'dom-remove')
+        ORDER BY id ASC
+    `, roomID, id, layer)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var result []config.DomObjectNetwork
+	events := []config.Event{}
 
 	for rows.Next() {
-		var dom config.DomObjectNetwork
-		var t config.Transform
-
-		err := rows.Scan(
-			&dom.ID, &dom.Kind,
-			&t.X, &t.Y, &t.Rot, &t.W, &t.H, &dom.Payload, &dom.LayerIndex,
-		)
-		if err != nil {
+		var e config.Event
+		if err := rows.Scan(
+			&e.ID, &e.RoomID, &e.UserID, &e.EntityID, &e.Op, &e.Payload, &e.CreatedAt,
+		); err != nil {
 			return nil, err
 		}
+		events = append(events, e)
+	}
+
+	return events, nil
+}
+
+func (s *sqlStore) GetActiveDomObjects(roomID string, layer int64) ([]config.DomObjectNetwork, error) {
+	return activeDomObjects(s, roomID, layer)
+}
+
+func (s *sqlStore) GetDomObject(roomID string, id string) (config.DomObjectNetwork, bool, error) {
+	var dom config.DomObjectNetwork
+	var t config.Transform
+
+	err := s.QueryRow(`
+        SELECT
+            id, user_id, kind, x, y, rot, w, h, payload, layer
+        FROM dom_objects
+        WHERE room_id = ?
+        AND id = ?
+        AND is_removed = 0
+    `, roomID, id).Scan(
+		&dom.ID, &dom.UserId, &dom.Kind,
+		&t.X, &t.Y, &t.Rot, &t.W, &t.H, &dom.Payload, &dom.LayerIndex,
+	)
 
-		dom.Transform = t
-		result = append(result, dom)
+	if err == sql.ErrNoRows {
+		return dom, false, nil
+	}
+	if err != nil {
+		return dom, false, err
 	}
 
-	return result, nil
+	dom.Transform = t
+	return dom, true, nil
 }
 
-func GetMaxIdByRoom(roomID string) (int64, error) {
+func (s *sqlStore) GetMaxIdByRoom(roomID string) (int64, error) {
 	var maxID int64
 
-	err := W.db.QueryRow(`
-		SELECT COALESCE(MAX(id), 0)
-		FROM events
-		WHERE room_id = ?
-	`, roomID).Scan(&maxID)
+	// compaction can prune events, so the snapshot clock counts too
+	err := s.QueryRow(`
+		SELECT `+s.d.greatest+`(
+			COALESCE((SELECT MAX(id) FROM events WHERE room_id = ?), 0),
+			COALESCE((SELECT MAX(clock) FROM snapshots WHERE room_id = ?), 0)
+		)
+	`, roomID, roomID).Scan(&maxID)
 
 	if err != nil {
 		return 0, err
@@ -759,10 +596,10 @@ const (
 	Perm
 )
 
-func CheckRegister(userId string) (ViewResult, error) {
+func (s *sqlStore) CheckRegister(userId string) (ViewResult, error) {
 	var dummy int
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT 1
 		FROM users_data
 		WHERE user_id = ?
@@ -778,11 +615,11 @@ func CheckRegister(userId string) (ViewResult, error) {
 	return Perm, nil
 }
 
-func CheckCanViewRoom(roomId string, userId string) (ViewResult, error) {
+func (s *sqlStore) CheckCanViewRoom(roomId string, userId string) (ViewResult, error) {
 	var ownerID string
 	var isPublic int
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT owner_id, public
 		FROM rooms
 		WHERE room_id = ?
@@ -802,11 +639,11 @@ func CheckCanViewRoom(roomId string, userId string) (ViewResult, error) {
 	return NoPerm, nil
 }
 
-func CheckcanEditRoom(roomId string, userId string) (ViewResult, error) {
+func (s *sqlStore) CheckcanEditRoom(roomId string, userId string) (ViewResult, error) {
 	var ownerID string
 	var isPublic int
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT owner_id, public
 		FROM rooms
 		WHERE room_id = ?
@@ -826,10 +663,10 @@ func CheckcanEditRoom(roomId string, userId string) (ViewResult, error) {
 	return NoPerm, nil
 }
 
-func GetUserIDByEmail(email string) (string, error) {
+func (s *sqlStore) GetUserIDByEmail(email string) (string, error) {
 	var userID string
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT user_id
 		FROM users_data
 		WHERE email = ?
@@ -845,10 +682,10 @@ func GetUserIDByEmail(email string) (string, error) {
 	return userID, nil
 }
 
-func GetUserRole(userId string) (int, error) {
+func (s *sqlStore) GetUserRole(userId string) (int, error) {
 	var role int
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT role
 		FROM users_data
 		WHERE user_id = ?
@@ -864,10 +701,10 @@ func GetUserRole(userId string) (int, error) {
 	return role, nil
 }
 
-func GetUserRoomRole(roomId string, userId string) (int64, error) {
+func (s *sqlStore) GetUserRoomRole(roomId string, userId string) (int64, error) {
 	var role int64
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT role
 		FROM users_rooms
 		WHERE user_id = ? AND room_id = ?
@@ -883,10 +720,10 @@ func GetUserRoomRole(roomId string, userId string) (int64, error) {
 	return role, nil
 }
 
-func CheckRoomExisted(roomId string) (bool, error) {
+func (s *sqlStore) CheckRoomExisted(roomId string) (bool, error) {
 	var dummy string
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT 1
 		FROM rooms
 		WHERE room_id = ?
@@ -903,7 +740,7 @@ func CheckRoomExisted(roomId string) (bool, error) {
 	return true, nil
 }
 
-func GetAllUserInRoom(roomId string) ([]config.UserEvent, error) {
+func (s *sqlStore) GetAllUserInRoom(roomId string) ([]config.UserEvent, error) {
 	var (
 		rows *sql.Rows
 		err  error
@@ -911,7 +748,7 @@ func GetAllUserInRoom(roomId string) ([]config.UserEvent, error) {
 
 	if roomId != "" {
 		// room-based role
-		rows, err = W.db.Query(`
+		rows, err = s.Query(`
 			SELECT
 				u.user_id,
 				ur.role,           -- room role
@@ -925,7 +762,7 @@ func GetAllUserInRoom(roomId string) ([]config.UserEvent, error) {
 		`, roomId)
 	} else {
 		// global role
-		rows, err = W.db.Query(`
+		rows, err = s.Query(`
 			SELECT
 				user_id,
 				role,              -- global role
@@ -966,10 +803,10 @@ func GetAllUserInRoom(roomId string) ([]config.UserEvent, error) {
 	return users, nil
 }
 
-func GetAllAreaWithPerm(roomId string, userId string) ([]config.Area, error) {
+func (s *sqlStore) GetAllAreaWithPerm(roomId string, userId string) ([]config.Area, error) {
 	var perms []config.Area
 
-	rows, err := W.db.Query(`
+	rows, err := s.Query(`
         SELECT a.x, a.y, a.size
         FROM areas a
         LEFT JOIN users_area ua ON a.x = ua.x AND a.y = ua.y AND ua.user_id = ?
@@ -993,10 +830,10 @@ func GetAllAreaWithPerm(roomId string, userId string) ([]config.Area, error) {
 	return perms, nil
 }
 
-func CheckCanUseLayer(roomId string, layerIndex int64, userId string) (bool, error) {
+func (s *sqlStore) CheckCanUseLayer(roomId string, layerIndex int64, userId string) (bool, error) {
 	var dummy int
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT 1
 		FROM layers l
 		LEFT JOIN users_layers ul
@@ -1018,16 +855,47 @@ func CheckCanUseLayer(roomId string, layerIndex int64, userId string) (bool, err
 	return true, nil
 }
 
-func GetLayerByUserId(userId string, roomId string) (int64, error) {
+// GetRoomLayers lists every layer of a room by index, permissions are up
+// to the caller (CheckCanUseLayer).
+func (s *sqlStore) GetRoomLayers(roomId string) ([]config.Layer, error) {
+	return roomLayers(s, roomId)
+}
+
+func roomLayers(q queryer, roomId string) ([]config.Layer, error) {
+	rows, err := q.Query(`
+		SELECT layer_index, owner_id, name, public, created_at
+		FROM layers
+		WHERE room_id = ?
+		ORDER BY layer_index ASC
+	`, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	layers := []config.Layer{}
+	for rows.Next() {
+		l := config.Layer{RoomID: roomId}
+		var public int
+		if err := rows.Scan(&l.Index, &l.User, &l.Name, &public, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		l.Public = public == 1
+		layers = append(layers, l)
+	}
+	return layers, rows.Err()
+}
+
+func (s *sqlStore) GetLayerByUserId(userId string, roomId string) (int64, error) {
 	var layerIndex int64
 
-	err := W.db.QueryRow(`
+	err := s.QueryRow(`
 		SELECT layer_index
 		FROM users_layers
 		WHERE room_id = ?
 		  AND user_id = ?
 		LIMIT 1
-	`, roomId, userId, userId).Scan(&layerIndex)
+	`, roomId, userId).Scan(&layerIndex)
 
 	if err == sql.ErrNoRows {
 		return -1, nil // User doesn't have a private layer yet
@@ -1038,8 +906,8 @@ func GetLayerByUserId(userId string, roomId string) (int64, error) {
 
 	return layerIndex, nil
 }
-func GetAllRooms(userId string) ([]config.RoomEvent, error) {
-	rows, err := W.db.Query(`
+func (s *sqlStore) GetAllRooms(userId string) ([]config.RoomEvent, error) {
+	rows, err := s.Query(`
 		SELECT r.room_id, r.owner_id, r.public
 		FROM rooms r
 		LEFT JOIN users_rooms ur ON r.room_id = ur.room_id AND ur.user_id = ?
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// ev is a stroke or dom event on layer of room "r" at clock id
+type ev struct {
+	id     int64
+	op     string
+	entity string
+	layer  int64
+}
+
+func writeEvents(t testing.TB, room string, events []ev) {
+	t.Helper()
+
+	for _, e := range events {
+		payload := json.RawMessage(`{}`)
+		if e.op == "stroke-add" {
+			payload, _ = json.Marshal(config.StrokeObjectInterface{ID: e.entity, Kind: "stroke"})
+		}
+		WriteEvent(config.Event{
+			EventMeta: config.EventMeta{ID: e.id, RoomID: room, UserID: "u", LayerIndex: e.layer},
+			EntityID:  e.entity,
+			Op:        e.op,
+			Payload:   payload,
+			CreatedAt: e.id,
+		})
+	}
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func entities(events []config.Event) []string {
+	ids := []string{}
+	for _, e := range events {
+		ids = append(ids, e.EntityID)
+	}
+	return ids
+}
+
+// undo writes a stroke-remove, redo the stroke-add again (ws.applyHistory)
+var historyCases = []struct {
+	name   string
+	events []ev
+	live   []string // GetStrokeState and GetEvent from 0
+}{
+	{
+		name:   "adds",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "stroke-add", "b", 0}},
+		live:   []string{"a", "b"},
+	},
+	{
+		name:   "undo",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "stroke-add", "b", 0}, {3, "stroke-remove", "b", 0}},
+		live:   []string{"a"},
+	},
+	{
+		name:   "undo then redo",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "stroke-remove", "a", 0}, {3, "stroke-add", "a", 0}},
+		live:   []string{"a"},
+	},
+	{
+		name:   "undo, redo, undo",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "stroke-remove", "a", 0}, {3, "stroke-add", "a", 0}, {4, "stroke-remove", "a", 0}},
+		live:   []string{},
+	},
+	{
+		name: "batch remove",
+		events: []ev{
+			{1, "stroke-add", "a", 0}, {2, "stroke-add", "b", 0}, {3, "stroke-add", "c", 0},
+			{4, "stroke-remove", "a", 0}, {4, "stroke-remove", "c", 0},
+		},
+		live: []string{"b"},
+	},
+	{
+		name:   "other layer",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "stroke-add", "b", 1}, {3, "stroke-remove", "b", 1}},
+		live:   []string{"a"},
+	},
+	{
+		// a remove sent from layer 1 naming a layer 0 stroke
+		name:   "remove from another layer",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "stroke-remove", "a", 1}},
+		live:   []string{"a"},
+	},
+	{
+		name:   "doms are not strokes",
+		events: []ev{{1, "stroke-add", "a", 0}, {2, "dom-add", "d", 0}, {3, "dom-remove", "d", 0}},
+		live:   []string{"a"},
+	},
+}
+
+func TestGetStrokeState(t *testing.T) {
+	for _, tt := range historyCases {
+		t.Run(tt.name, func(t *testing.T) {
+			OpenTestStore(t)
+			writeEvents(t, "r", tt.events)
+
+			state, _, err := GetStrokeState("r", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entities(state); !reflect.DeepEqual(got, tt.live) {
+				t.Fatalf("GetStrokeState = %v, want %v", got, tt.live)
+			}
+
+			// the resume query leaves removed strokes out the same way
+			events, err := GetEvent("r", "0", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entities(events); !reflect.DeepEqual(got, tt.live) {
+				t.Fatalf("GetEvent = %v, want %v", got, tt.live)
+			}
+		})
+	}
+}
+
+func TestGetRemovedSince(t *testing.T) {
+	events := []ev{
+		{1, "stroke-add", "a", 0},
+		{2, "stroke-add", "b", 0},
+		{3, "dom-add", "d", 0},
+		{4, "stroke-remove", "a", 0},
+		{5, "stroke-add", "x", 1},
+		{6, "stroke-remove", "x", 1},
+		{7, "dom-remove", "d", 0},
+		{8, "stroke-add", "a", 0}, // redo
+		{9, "stroke-remove", "b", 0},
+	}
+
+	tests := []struct {
+		name  string
+		since int64
+		layer int64
+		want  []string
+	}{
+		{"from the start", 0, 0, []string{"a", "d", "b"}},
+		{"after the first remove", 4, 0, []string{"d", "b"}},
+		{"up to date", 9, 0, []string{}},
+		{"other layer", 0, 1, []string{"x"}},
+	}
+
+	OpenTestStore(t)
+	writeEvents(t, "r", events)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			removed, err := GetRemovedSince("r", tt.since, tt.layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entities(removed); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("GetRemovedSince(%d) = %v, want %v", tt.since, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// ArchiveVersion is written into every export, importers refuse newer ones
+const ArchiveVersion = 1
+
+// ExportRoom reads everything needed to rebuild a room elsewhere in one
+// transaction, so the archive is a consistent cut. Returns nil when the room
+// does not exist.
+func (s *sqlStore) ExportRoom(roomID string) (*config.RoomArchive, error) {
+	tx, err := s.begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	a := &config.RoomArchive{
+		Version:    ArchiveVersion,
+		ExportedAt: time.Now().UnixMilli(),
+		Layers:     []config.Layer{},
+		LayerUsers: []config.ArchiveLayerUser{},
+		Members:    []config.ArchiveMember{},
+		Events:     []config.ArchiveEvent{},
+		Doms:       []config.DomEvent{},
+		Snapshots:  []config.Snapshot{},
+		ObjectKeys: []string{},
+	}
+
+	found, err := exportRoomRow(tx, roomID, &a.Room)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	steps := []func(queryer, string, *config.RoomArchive) error{
+		exportLayers,
+		exportMembers,
+		exportEvents,
+		exportDoms,
+		exportSnapshots,
+		exportPermissions,
+	}
+	for _, step := range steps {
+		if err := step(tx, roomID, a); err != nil {
+			return nil, err
+		}
+	}
+
+	a.ObjectKeys = objectKeys(a)
+	return a, nil
+}
+
+func exportRoomRow(q queryer, roomID string, r *config.ArchiveRoom) (bool, error) {
+	err := q.QueryRow(`
+		SELECT room_id, owner_id, public, anonymous, created_at
+		FROM rooms
+		WHERE room_id = ?
+	`, roomID).Scan(&r.RoomID, &r.OwnerID, &r.Public, &r.Anonymous, &r.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func exportLayers(q queryer, roomID string, a *config.RoomArchive) error {
+	layers, err := roomLayers(q, roomID)
+	if err != nil {
+		return err
+	}
+	a.Layers = append(a.Layers, layers...)
+
+	rows, err := q.Query(`
+		SELECT layer_index, user_id
+		FROM users_layers
+		WHERE room_id = ?
+		ORDER BY layer_index ASC, user_id ASC
+	`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var lu config.ArchiveLayerUser
+		if err := rows.Scan(&lu.Layer, &lu.UserID); err != nil {
+			return err
+		}
+		a.LayerUsers = append(a.LayerUsers, lu)
+	}
+	return rows.Err()
+}
+
+func exportMembers(q queryer, roomID string, a *config.RoomArchive) error {
+	rows, err := q.Query(`
+		SELECT user_id, role, joined_at
+		FROM users_rooms
+		WHERE room_id = ?
+		ORDER BY joined_at ASC
+	`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var m config.ArchiveMember
+		if err := rows.Scan(&m.UserID, &m.Role, &m.JoinedAt); err != nil {
+			return err
+		}
+		a.Members = append(a.Members, m)
+	}
+	return rows.Err()
+}
+
+func exportEvents(q queryer, roomID string, a *config.RoomArchive) error {
+	rows, err := q.Query(`
+		SELECT id, room_id, user_id, entity_id, op, payload, layer, created_at, seq
+		FROM events
+		WHERE room_id = ?
+		ORDER BY seq ASC
+	`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e config.ArchiveEvent
+		if err := rows.Scan(
+			&e.ID, &e.RoomID, &e.UserID, &e.EntityID, &e.Op, &e.Payload, &e.LayerIndex, &e.CreatedAt, &e.Seq,
+		); err != nil {
+			return err
+		}
+		a.Events = append(a.Events, e)
+	}
+	return rows.Err()
+}
+
+func exportDoms(q queryer, roomID string, a *config.RoomArchive) error {
+	rows, err := q.Query(`
+		SELECT
+			id, user_id, kind, x, y, rot, w, h, payload, layer, created_at, updated_at
+		FROM dom_objects
+		WHERE room_id = ? AND is_removed = 0
+		ORDER BY created_at ASC
+	`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		d := config.DomEvent{RoomID: roomID}
+		t := &d.Transform
+		if err := rows.Scan(
+			&d.ID, &d.UserID, &d.Kind,
+			&t.X, &t.Y, &t.Rot, &t.W, &t.H, &d.Payload, &d.LayerIndex,
+			&d.CreatedAt, &d.UpdatedAt,
+		); err != nil {
+			return err
+		}
+		a.Doms = append(a.Doms, d)
+	}
+	return rows.Err()
+}
+
+func exportSnapshots(q queryer, roomID string, a *config.RoomArchive) error {
+	rows, err := q.Query(`
+		SELECT layer, seq, clock, strokes, doms, created_at, compacted
+		FROM snapshots
+		WHERE room_id = ?
+		ORDER BY layer ASC, seq ASC
+	`, roomID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		snap := config.Snapshot{RoomID: roomID}
+		var strokesRaw, domsRaw []byte
+		var compacted int
+		if err := rows.Scan(
+			&snap.Layer, &snap.Seq, &snap.Clock, &strokesRaw, &domsRaw, &snap.CreatedAt, &compacted,
+		); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(strokesRaw, &snap.Strokes); err != nil {
+			return err
+		}
+		if err := json.Unmarshal(domsRaw, &snap.Doms); err != nil {
+			return err
+		}
+		snap.Compacted = compacted == 1
+		a.Snapshots = append(a.Snapshots, snap)
+	}
+	return rows.Err()
+}
+
+func exportPermissions(q queryer, roomID string, a *config.RoomArchive) error {
+	perms, err := roomPermissions(q, roomID)
+	if err != nil {
+		return err
+	}
+	if len(perms) > 0 {
+		a.Permissions = perms
+	}
+	return nil
+}
+
+// objectKeys collects the R2 keys the room points at. Uploaded dom objects
+// use their object key as id (see api.UploadHandler), removed ones are kept
+// since replaying the events still shows them.
+func objectKeys(a *config.RoomArchive) []string {
+	seen := map[string]bool{}
+	add := func(id string) {
+		if strings.HasPrefix(id, "rooms/") {
+			seen[id] = true
+		}
+	}
+
+	for _, d := range a.Doms {
+		add(d.ID)
+	}
+	for _, e := range a.Events {
+		if e.Op == "dom-add" {
+			add(e.EntityID)
+		}
+	}
+	for _, snap := range a.Snapshots {
+		for _, d := range snap.Doms {
+			add(d.ID)
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,60 +1,82 @@
 package db
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/Tk21111/whiteboard_server/config"
 )
 
-func EnsureUserInRoom(roomId, userId string) (config.Role, error) {
-
-	roomRole, err := GetUserRoomRole(roomId, userId)
-	if err != nil && roomRole == -2 {
-		return -1, err
-	}
-
-	if roomRole >= 0 {
-		return config.Role(roomRole), nil
-	}
+var (
+	ErrRoomNotFound = errors.New("room not found")
+	ErrForbidden    = errors.New("forbidden")
+)
 
-	globalRole, err := GetUserRole(userId)
+// RoomRole is the role of a user in a room (see RoomAccess.Role), ok is
+// false when they can not view it. It only reads, joining and creating
+// rooms go through JoinRoomAs and CreateRoomAs.
+func RoomRole(roomId, userId string) (config.Role, bool, error) {
+	access, err := GetRoomAccess(roomId, userId)
 	if err != nil {
-		return -1, err
+		return 0, false, err
 	}
 
-	if globalRole == int(config.RoleModerator) || globalRole == int(config.RoleOwner) {
+	role, ok := access.Role()
+	return role, ok, nil
+}
 
-		exist, err := CheckRoomExisted(roomId)
-		if err != nil {
-			return -1, err
-		}
+// CanView reads the access of userId and checks RoomAccess.CanView
+func CanView(roomId, userId string) (bool, error) {
+	access, err := GetRoomAccess(roomId, userId)
+	return access.CanView(), err
+}
 
-		if !exist {
-			fmt.Println("dadkandjkomkonm")
-			if err := CreateRoom(roomId, userId, 1, 4, 2); err != nil {
-				return -1, err
-			}
-		}
+// JoinRoomAs makes the user a member of a public room. Users that already
+// have a role keep it and nothing is written.
+func JoinRoomAs(roomId, userId string) (config.Role, error) {
+	access, err := GetRoomAccess(roomId, userId)
+	if err != nil {
+		return 0, err
+	}
+	if !access.Exists {
+		return 0, ErrRoomNotFound
+	}
 
-		if err := JoinRoom(roomId, userId, config.RoleOwner); err != nil {
-			return -1, err
-		}
+	// members, the owner and admins
+	if role, ok := access.Role(); ok && (access.RoomRole >= 0 || role == config.RoleOwner) {
+		return role, nil
+	}
+	if !access.Public {
+		return 0, ErrForbidden
+	}
 
-		return config.RoleOwner, nil
+	if err := JoinRoom(roomId, userId, config.RoleMember); err != nil {
+		return 0, err
 	}
+	Audit(roomId, userId, userId, "join", config.RoleMember)
 
-	view, err := CheckCanViewRoom(roomId, userId)
+	return config.RoleMember, nil
+}
+
+// CreateRoomAs creates a room owned by userId, who gets RoleOwner in it
+func CreateRoomAs(roomId, userId string, public bool) error {
+	exists, err := CheckRoomExisted(roomId)
 	if err != nil {
-		return -1, err
+		return err
 	}
-
-	if view != Perm {
-		return -1, fmt.Errorf("forbidden")
+	if exists {
+		return ErrRoomExists
 	}
 
-	if err := JoinRoom(roomId, userId, config.RoleMember); err != nil {
-		return -1, err
+	var p int8
+	if public {
+		p = 1
+	}
+	if err := CreateRoom(roomId, userId, p, 4, 2); err != nil {
+		return err
 	}
+	Audit(roomId, userId, userId, "create", config.RoleOwner)
+	fmt.Println("[room] created", roomId, "owner", userId)
 
-	return config.RoleModerator, nil
+	return nil
 }
@@ -0,0 +1,471 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/google/uuid"
+)
+
+var ErrRoomExists = errors.New("room already exists")
+
+type ImportOptions struct {
+	RoomID  string // new room, must not exist
+	OwnerID string
+	// layers to copy, nil copies all; layer 0 is always created
+	Layers []int64
+	// keep the other members and their layers, otherwise everything the
+	// old owner or a member owned goes to OwnerID
+	KeepMembers bool
+}
+
+// ImportRoom creates opts.RoomID from an archive. Dom ids are object keys
+// and unique across rooms, so they are moved under the new room; the
+// returned map (old key -> new key) has to be copied in R2 by the caller.
+// It only holds keys of the archived room (rooms/<a.Room.RoomID>/...).
+// Clocks are renumbered from 1, stroke ids are room scoped and kept.
+func ImportRoom(a *config.RoomArchive, opts ImportOptions) (map[string]string, error) {
+	if W == nil {
+		return nil, fmt.Errorf("writer not initialized")
+	}
+
+	rewritten, keys, err := rewriteArchive(a, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+
+	err = W.enqueue(DbJob{
+		Type: OpRoomImport,
+		Import: config.ImportEvent{
+			Archive: rewritten,
+			Result:  result,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := <-result; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ImportRoomFile is ImportRoom from an archive written by export
+func ImportRoomFile(path string, opts ImportOptions) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var a config.RoomArchive
+	if err := json.NewDecoder(f).Decode(&a); err != nil {
+		return nil, err
+	}
+	return ImportRoom(&a, opts)
+}
+
+// CloneRoom is ImportRoom from the current state of an existing room
+func CloneRoom(srcRoomID string, opts ImportOptions) (map[string]string, error) {
+	a, err := ExportRoom(srcRoomID)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return nil, fmt.Errorf("room %s not found", srcRoomID)
+	}
+	return ImportRoom(a, opts)
+}
+
+// rewriteArchive returns a copy of a that belongs to the new room. Seqs are
+// left alone, the writer hands out new ones in the same order.
+func rewriteArchive(a *config.RoomArchive, opts ImportOptions) (*config.RoomArchive, map[string]string, error) {
+	if a.Version > ArchiveVersion {
+		return nil, nil, fmt.Errorf("archive version %d is newer than %d", a.Version, ArchiveVersion)
+	}
+	if opts.RoomID == "" || opts.OwnerID == "" {
+		return nil, nil, fmt.Errorf("room and owner required")
+	}
+
+	oldRoom := a.Room.RoomID
+	newRoom := opts.RoomID
+
+	keep := func(layer int64) bool { return true }
+	if opts.Layers != nil {
+		set := map[int64]bool{}
+		for _, l := range opts.Layers {
+			set[l] = true
+		}
+		keep = func(layer int64) bool { return set[layer] }
+	}
+
+	user := func(id string) string {
+		if id == a.Room.OwnerID || !opts.KeepMembers {
+			return opts.OwnerID
+		}
+		return id
+	}
+
+	keys := map[string]string{}
+	domIDs := map[string]string{}
+	domID := func(id string) string {
+		if id == "" {
+			return id
+		}
+		if n, ok := domIDs[id]; ok {
+			return n
+		}
+
+		var n string
+		switch {
+		case strings.HasPrefix(id, "rooms/"+oldRoom+"/"):
+			n = "rooms/" + newRoom + "/" + strings.TrimPrefix(id, "rooms/"+oldRoom+"/")
+			keys[id] = n
+		case strings.HasPrefix(id, "rooms/"):
+			// an object of some other room, never copied so an archive
+			// can not pull it in; the dom keeps a key with no object
+			n = "rooms/" + newRoom + "/" + uuid.NewString()
+		default:
+			n = uuid.NewString()
+		}
+		domIDs[id] = n
+		return n
+	}
+
+	out := &config.RoomArchive{
+		Version:    ArchiveVersion,
+		ExportedAt: a.ExportedAt,
+		Room: config.ArchiveRoom{
+			RoomID:    newRoom,
+			OwnerID:   opts.OwnerID,
+			Public:    a.Room.Public,
+			Anonymous: a.Room.Anonymous,
+			CreatedAt: time.Now().UnixMilli(),
+		},
+	}
+
+	for op, role := range a.Permissions {
+		if !config.ValidPermissionKey(op) {
+			continue
+		}
+		if out.Permissions == nil {
+			out.Permissions = config.Permissions{}
+		}
+		out.Permissions[op] = role
+	}
+
+	// layers, layer 0 is where every client starts
+	hasBase := false
+	for _, l := range a.Layers {
+		if !keep(l.Index) {
+			continue
+		}
+		l.RoomID = newRoom
+		l.User = user(l.User)
+		hasBase = hasBase || l.Index == 0
+		out.Layers = append(out.Layers, l)
+	}
+	if !hasBase {
+		out.Layers = append([]config.Layer{{
+			RoomID:    newRoom,
+			Index:     0,
+			User:      opts.OwnerID,
+			Name:      "Base Layer",
+			Public:    true,
+			CreatedAt: out.Room.CreatedAt,
+		}}, out.Layers...)
+	}
+
+	seenLayerUser := map[config.ArchiveLayerUser]bool{}
+	for _, lu := range a.LayerUsers {
+		if !keep(lu.Layer) {
+			continue
+		}
+		lu.UserID = user(lu.UserID)
+		if !seenLayerUser[lu] {
+			seenLayerUser[lu] = true
+			out.LayerUsers = append(out.LayerUsers, lu)
+		}
+	}
+
+	out.Members = append(out.Members, config.ArchiveMember{
+		UserID:   opts.OwnerID,
+		Role:     config.RoleOwner,
+		JoinedAt: out.Room.CreatedAt,
+	})
+	if opts.KeepMembers {
+		for _, m := range a.Members {
+			if m.UserID == a.Room.OwnerID || m.UserID == opts.OwnerID {
+				continue
+			}
+			out.Members = append(out.Members, m)
+		}
+	}
+
+	// clocks, renumbered in order so a filtered room has no gaps
+	clocks := map[int64]int64{}
+	for _, e := range a.Events {
+		if keep(e.LayerIndex) {
+			clocks[e.ID] = 0
+		}
+	}
+	for _, snap := range a.Snapshots {
+		if keep(snap.Layer) {
+			clocks[snap.Clock] = 0
+			for _, e := range snap.Strokes {
+				clocks[e.ID] = 0
+			}
+		}
+	}
+	ordered := make([]int64, 0, len(clocks))
+	for c := range clocks {
+		ordered = append(ordered, c)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i] < ordered[j] })
+	for i, c := range ordered {
+		clocks[c] = int64(i + 1)
+	}
+
+	rewriteEvent := func(e config.Event) (config.Event, error) {
+		e.ID = clocks[e.ID]
+		e.RoomID = newRoom
+		if strings.HasPrefix(e.Op, "dom-") {
+			e.EntityID = domID(e.EntityID)
+			payload, err := rewriteDomPayload(e.Payload, newRoom, domID)
+			if err != nil {
+				return e, fmt.Errorf("event %s: %w", e.EntityID, err)
+			}
+			e.Payload = payload
+		}
+		return e, nil
+	}
+
+	for _, e := range a.Events {
+		if !keep(e.LayerIndex) {
+			continue
+		}
+		ev, err := rewriteEvent(e.Event)
+		if err != nil {
+			return nil, nil, err
+		}
+		out.Events = append(out.Events, config.ArchiveEvent{Event: ev, Seq: e.Seq})
+	}
+
+	for _, d := range a.Doms {
+		if !keep(d.LayerIndex) {
+			continue
+		}
+		d.ID = domID(d.ID)
+		d.RoomID = newRoom
+		out.Doms = append(out.Doms, d)
+	}
+
+	for _, snap := range a.Snapshots {
+		if !keep(snap.Layer) {
+			continue
+		}
+		snap.RoomID = newRoom
+		snap.Clock = clocks[snap.Clock]
+
+		strokes := make([]config.Event, 0, len(snap.Strokes))
+		for _, e := range snap.Strokes {
+			ev, err := rewriteEvent(e)
+			if err != nil {
+				return nil, nil, err
+			}
+			strokes = append(strokes, ev)
+		}
+		snap.Strokes = strokes
+
+		doms := make([]config.DomObjectNetwork, 0, len(snap.Doms))
+		for _, d := range snap.Doms {
+			d.ID = domID(d.ID)
+			doms = append(doms, d)
+		}
+		snap.Doms = doms
+
+		out.Snapshots = append(out.Snapshots, snap)
+	}
+
+	return out, keys, nil
+}
+
+func rewriteDomPayload(payload json.RawMessage, roomID string, domID func(string) string) (json.RawMessage, error) {
+	var m config.NetworkMsg
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, err
+	}
+
+	m.ID = domID(m.ID)
+	if m.DomObject != nil {
+		m.DomObject.ID = domID(m.DomObject.ID)
+	}
+	if m.Layer != nil && m.Layer.RoomID != "" {
+		m.Layer.RoomID = roomID
+	}
+
+	return json.Marshal(m)
+}
+
+// runs inside writerLoop, seqs continue from w.seq in archive order
+func (w *Writer) importRoom(a *config.RoomArchive) error {
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM rooms WHERE room_id = ?`, a.Room.RoomID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists > 0 {
+		return ErrRoomExists
+	}
+
+	r := a.Room
+	_, err = tx.Exec(`
+		INSERT INTO rooms (room_id, owner_id, public, anonymous, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, r.RoomID, r.OwnerID, r.Public, r.Anonymous, r.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range a.Members {
+		_, err = tx.Exec(`
+			INSERT INTO users_rooms (user_id, room_id, role, joined_at)
+			VALUES (?, ?, ?, ?)
+		`, m.UserID, r.RoomID, int(m.Role), m.JoinedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for op, role := range a.Permissions {
+		_, err = tx.Exec(`
+			INSERT INTO room_permissions (room_id, op, role)
+			VALUES (?, ?, ?)
+		`, r.RoomID, op, int(role))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, l := range a.Layers {
+		public := 0
+		if l.Public {
+			public = 1
+		}
+		_, err = tx.Exec(`
+			INSERT INTO layers (room_id, layer_index, owner_id, name, public, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, r.RoomID, l.Index, l.User, l.Name, public, l.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, lu := range a.LayerUsers {
+		_, err = tx.Exec(`
+			INSERT INTO users_layers (room_id, layer_index, user_id)
+			VALUES (?, ?, ?)
+		`, r.RoomID, lu.Layer, lu.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// old seq -> new seq, for the snapshot cuts below
+	seq := w.seq
+	type cut struct{ old, new int64 }
+	cuts := make([]cut, 0, len(a.Events))
+
+	for _, e := range a.Events {
+		seq++
+		_, err = tx.Exec(`
+			INSERT INTO events
+			(id, room_id, user_id, entity_id, op, payload, layer, created_at, seq)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, e.ID, r.RoomID, e.UserID, e.EntityID, e.Op, []byte(e.Payload), e.LayerIndex, e.CreatedAt, seq)
+		if err != nil {
+			return err
+		}
+		cuts = append(cuts, cut{e.Seq, seq})
+	}
+
+	for _, d := range a.Doms {
+		_, err = tx.Exec(`
+			INSERT INTO dom_objects
+			(
+				id, room_id, user_id, kind,
+				x, y, rot, w, h,
+				payload, layer,
+				created_at, updated_at
+			)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`,
+			d.ID, r.RoomID, d.UserID, d.Kind,
+			d.Transform.X, d.Transform.Y, d.Transform.Rot, d.Transform.W, d.Transform.H,
+			d.Payload, d.LayerIndex,
+			d.CreatedAt, d.UpdatedAt,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, snap := range a.Snapshots {
+		// last imported event the snapshot covered, events are in seq order
+		newSeq := w.seq
+		i := sort.Search(len(cuts), func(i int) bool { return cuts[i].old > snap.Seq })
+		if i > 0 {
+			newSeq = cuts[i-1].new
+		}
+
+		strokesRaw, err := json.Marshal(snap.Strokes)
+		if err != nil {
+			return err
+		}
+		domsRaw, err := json.Marshal(snap.Doms)
+		if err != nil {
+			return err
+		}
+
+		compacted := 0
+		if snap.Compacted {
+			compacted = 1
+		}
+
+		_, err = tx.Exec(`
+			INSERT INTO snapshots (room_id, layer, seq, clock, strokes, doms, compacted, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			-- dropped layers can leave two cuts on one seq, the later wins
+			ON CONFLICT (room_id, layer, seq) DO UPDATE SET
+				clock = excluded.clock,
+				strokes = excluded.strokes,
+				doms = excluded.doms,
+				compacted = excluded.compacted,
+				created_at = excluded.created_at
+		`, r.RoomID, snap.Layer, newSeq, snap.Clock, strokesRaw, domsRaw, compacted, snap.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	w.seq = seq
+	return nil
+}
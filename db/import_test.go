@@ -0,0 +1,204 @@
+package db
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+func TestRewriteArchiveObjectKeys(t *testing.T) {
+	a := &config.RoomArchive{
+		Version: ArchiveVersion,
+		Room:    config.ArchiveRoom{RoomID: "src", OwnerID: "owner"},
+		Doms: []config.DomEvent{
+			{DomObjectNetwork: config.DomObjectNetwork{ID: "rooms/src/own.png"}},
+			{DomObjectNetwork: config.DomObjectNetwork{ID: "rooms/victim/secret.png"}},
+			{DomObjectNetwork: config.DomObjectNetwork{ID: "local-id"}},
+		},
+	}
+
+	out, keys, err := rewriteArchive(a, ImportOptions{RoomID: "dst", OwnerID: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys["rooms/src/own.png"] != "rooms/dst/own.png" {
+		t.Fatalf("keys %v, want only the source room object", keys)
+	}
+
+	if len(out.Doms) != len(a.Doms) {
+		t.Fatalf("%d doms, want %d", len(out.Doms), len(a.Doms))
+	}
+	for _, d := range out.Doms {
+		if strings.HasPrefix(d.ID, "rooms/") && !strings.HasPrefix(d.ID, "rooms/dst/") {
+			t.Fatalf("dom %s left outside the new room", d.ID)
+		}
+	}
+}
+
+// seedArchiveRoom writes room "src" with a private layer 1, clocks are
+// spread out so the import has something to renumber
+func seedArchiveRoom(t *testing.T) {
+	t.Helper()
+
+	if err := CreateRoomAs("src", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateLayer("src", "owner", "notes", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	writeEvents(t, "src", []ev{
+		{10, "stroke-add", "a", 0},
+		{20, "stroke-add", "b", 0},
+		{30, "stroke-add", "p", 1},
+	})
+
+	dom := config.DomObjectNetwork{ID: "rooms/src/img.png", Kind: "img", Transform: config.Transform{W: 10, H: 10}}
+	payload, _ := json.Marshal(config.NetworkMsg{Operation: "dom-add", ID: dom.ID, DomObject: &dom})
+	WriteDom(config.DomEvent{DomObjectNetwork: dom, RoomID: "src", UserID: "owner"}, OpDomCreate)
+	WriteEvent(config.Event{
+		EventMeta: config.EventMeta{ID: 40, RoomID: "src", UserID: "owner"},
+		EntityID:  dom.ID,
+		Op:        "dom-add",
+		Payload:   payload,
+		CreatedAt: 40,
+	})
+
+	// a snapshot cut in the middle, then more history after it
+	if err := CreateSnapshot("src", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	writeEvents(t, "src", []ev{
+		{50, "stroke-add", "c", 0},
+		{60, "stroke-remove", "a", 0},
+	})
+}
+
+// exported reads an archive back the way the export file and the import
+// endpoint carry it
+func exported(t *testing.T, roomID string) *config.RoomArchive {
+	t.Helper()
+
+	a, err := ExportRoom(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == nil {
+		t.Fatalf("room %s not found", roomID)
+	}
+
+	raw, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out config.RoomArchive
+	if err := json.Unmarshal(raw, &out); err != nil {
+		t.Fatal(err)
+	}
+	return &out
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	OpenTestStore(t)
+	seedArchiveRoom(t)
+	src := exported(t, "src")
+
+	tests := []struct {
+		name   string
+		room   string
+		layers []int64
+	}{
+		{"every layer", "copy", nil},
+		{"base layer only", "copy-base", []int64{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := ImportRoom(src, ImportOptions{RoomID: tt.room, OwnerID: "me", Layers: tt.layers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys["rooms/src/img.png"] != "rooms/"+tt.room+"/img.png" {
+				t.Fatalf("object keys %v", keys)
+			}
+
+			keep := func(layer int64) bool {
+				return tt.layers == nil || layer == 0
+			}
+			dst := exported(t, tt.room)
+
+			// same events in the same order, clocks renumbered from 1
+			var want []config.ArchiveEvent
+			for _, e := range src.Events {
+				if keep(e.LayerIndex) {
+					want = append(want, e)
+				}
+			}
+			if len(dst.Events) != len(want) {
+				t.Fatalf("%d events, want %d", len(dst.Events), len(want))
+			}
+			for i, e := range dst.Events {
+				w := want[i]
+				entity := w.EntityID
+				if n, ok := keys[entity]; ok {
+					entity = n
+				}
+				if e.ID != int64(i+1) || e.Op != w.Op || e.EntityID != entity || e.LayerIndex != w.LayerIndex {
+					t.Fatalf("event %d is %d %s %s on %d, want %d %s %s on %d",
+						i, e.ID, e.Op, e.EntityID, e.LayerIndex, i+1, w.Op, entity, w.LayerIndex)
+				}
+			}
+
+			for _, l := range src.Layers {
+				srcState, _, err := GetStrokeState("src", l.Index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dstState, _, err := GetStrokeState(tt.room, l.Index)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantState := entities(srcState)
+				if !keep(l.Index) {
+					wantState = []string{}
+				}
+				if got := entities(dstState); !reflect.DeepEqual(got, wantState) {
+					t.Fatalf("layer %d strokes %v, want %v", l.Index, got, wantState)
+				}
+			}
+
+			if len(dst.Doms) != 1 || dst.Doms[0].ID != "rooms/"+tt.room+"/img.png" || dst.Doms[0].Transform != src.Doms[0].Transform {
+				t.Fatalf("doms %+v, want the source dom under the new room", dst.Doms)
+			}
+
+			var layers []int64
+			for _, l := range dst.Layers {
+				layers = append(layers, l.Index)
+				if l.User != "me" {
+					t.Fatalf("layer %d owned by %s, want me", l.Index, l.User)
+				}
+			}
+			wantLayers := []int64{0, 1}
+			if tt.layers != nil {
+				wantLayers = tt.layers
+			}
+			if !reflect.DeepEqual(layers, wantLayers) {
+				t.Fatalf("layers %v, want %v", layers, wantLayers)
+			}
+
+			// the snapshot cut moves with its clock
+			for _, snap := range dst.Snapshots {
+				if snap.Clock < 1 || snap.Clock > int64(len(dst.Events)) {
+					t.Fatalf("snapshot at clock %d outside 1..%d", snap.Clock, len(dst.Events))
+				}
+			}
+			if len(dst.Snapshots) != 1 {
+				t.Fatalf("%d snapshots, want 1", len(dst.Snapshots))
+			}
+		})
+	}
+}
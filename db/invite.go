@@ -0,0 +1,221 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	// ErrInviteInvalid wraps why a redeem failed: revoked, expired or used up
+	ErrInviteInvalid = errors.New("invite is not valid")
+)
+
+// GetRoomInvites lists every invite of a room, newest first
+func (s *sqlStore) GetRoomInvites(roomId string) ([]config.Invite, error) {
+	rows, err := s.Query(`
+		SELECT id, room_id, role, created_by, max_uses, uses, revoked, expires_at, created_at
+		FROM invites
+		WHERE room_id = ?
+		ORDER BY created_at DESC
+	`, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []config.Invite{}
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, inv)
+	}
+
+	return invites, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanInvite(row scanner) (config.Invite, error) {
+	var inv config.Invite
+	var role, revoked int
+
+	err := row.Scan(
+		&inv.ID, &inv.RoomID, &role, &inv.CreatedBy,
+		&inv.MaxUses, &inv.Uses, &revoked, &inv.ExpiresAt, &inv.CreatedAt,
+	)
+	inv.Role = config.IntToRole(role)
+	inv.Revoked = revoked == 1
+	return inv, err
+}
+
+func CreateInvite(inv config.Invite) error {
+	return inviteJob(OpInviteCreate, config.InviteEvent{Invite: inv}, nil)
+}
+
+// RevokeInvite stops an invite of roomId from being redeemed, uses so far
+// stay
+func RevokeInvite(roomId, id string) error {
+	return inviteJob(OpInviteRevoke, config.InviteEvent{
+		Invite: config.Invite{ID: id, RoomID: roomId},
+	}, nil)
+}
+
+// RedeemInvite makes userId a member of the invite room with the invite
+// role, users that already have that role or a higher one keep theirs and
+// do not use the invite up. Returns the role the user ends up with.
+func RedeemInvite(id, userId string) (config.Role, error) {
+	role := make(chan config.Role, 1)
+
+	err := inviteJob(OpInviteRedeem, config.InviteEvent{
+		Invite: config.Invite{ID: id},
+		UserID: userId,
+	}, role)
+	if err != nil {
+		return 0, err
+	}
+	return <-role, nil
+}
+
+func inviteJob(op int, j config.InviteEvent, role chan config.Role) error {
+	if W == nil {
+		return fmt.Errorf("writer not initialized")
+	}
+
+	result := make(chan error, 1)
+	j.Result = result
+	j.Role = role
+
+	if err := W.enqueue(DbJob{Type: op, Invite: j}); err != nil {
+		return err
+	}
+	return <-result
+}
+
+// refused is a redeem or revoke the invite itself turned down, not a db
+// failure
+func refused(err error) bool {
+	return errors.Is(err, ErrInviteNotFound) || errors.Is(err, ErrInviteInvalid)
+}
+
+func (w *Writer) createInvite(j config.InviteEvent) error {
+	inv := j.Invite
+
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO invites (id, room_id, role, created_by, max_uses, uses, revoked, expires_at, created_at)
+		VALUES (?, ?, ?, ?, ?, 0, 0, ?, ?)
+	`, inv.ID, inv.RoomID, int(inv.Role), inv.CreatedBy, inv.MaxUses, inv.ExpiresAt, inv.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (w *Writer) revokeInvite(j config.InviteEvent) error {
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`
+		UPDATE invites SET revoked = 1
+		WHERE id = ? AND room_id = ?
+	`, j.Invite.ID, j.Invite.RoomID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		if err == nil {
+			err = ErrInviteNotFound
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// redeemInvite runs in the writer, so checking and counting a use can not
+// race with another redeem of the same invite
+func (w *Writer) redeemInvite(j config.InviteEvent) (config.Role, error) {
+	tx, err := w.store.begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	inv, err := scanInvite(tx.QueryRow(`
+		SELECT id, room_id, role, created_by, max_uses, uses, revoked, expires_at, created_at
+		FROM invites
+		WHERE id = ?
+	`, j.Invite.ID))
+	if err == sql.ErrNoRows {
+		return 0, ErrInviteNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var current int64
+	err = tx.QueryRow(`
+		SELECT role FROM users_rooms
+		WHERE user_id = ? AND room_id = ?
+	`, j.UserID, inv.RoomID).Scan(&current)
+	if err == nil && config.Role(current) >= inv.Role {
+		return config.Role(current), nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	now := time.Now().UnixMilli()
+	switch {
+	case inv.Revoked:
+		return 0, fmt.Errorf("%w: revoked", ErrInviteInvalid)
+	case inv.ExpiresAt <= now:
+		return 0, fmt.Errorf("%w: expired", ErrInviteInvalid)
+	case inv.MaxUses > 0 && inv.Uses >= inv.MaxUses:
+		return 0, fmt.Errorf("%w: used up", ErrInviteInvalid)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO users_rooms (user_id, room_id, role, joined_at)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id, room_id)
+		DO UPDATE SET
+			role = excluded.role
+	`, j.UserID, inv.RoomID, int(inv.Role), now)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`UPDATE invites SET uses = uses + 1 WHERE id = ?`, inv.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO room_audit (room_id, actor_id, user_id, action, role, created_at)
+		VALUES (?, ?, ?, 'invite', ?, ?)
+	`, inv.RoomID, inv.CreatedBy, j.UserID, int(inv.Role), now)
+	if err != nil {
+		return 0, err
+	}
+
+	return inv.Role, tx.Commit()
+}
@@ -0,0 +1,227 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is one step of the schema, either a .sql file under
+// migrations/<backend>/ or a Go func for changes sqlite can not express as plain SQL
+// (e.g. adding a column only when it is missing).
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	Up      func(tx *sql.Tx) error
+}
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this binary")
+
+// sqliteGoMigrations are merged with migrations/sqlite by version
+var sqliteGoMigrations = []Migration{
+	{
+		Version: 2,
+		Name:    "events_seq",
+		Up: func(tx *sql.Tx) error {
+			added, err := addColumnIfMissing(tx, "events", "seq", "INTEGER NOT NULL DEFAULT 0")
+			if err != nil || !added {
+				return err
+			}
+			// older rows keep their insert order
+			_, err = tx.Exec(`UPDATE events SET seq = rowid`)
+			return err
+		},
+	},
+	{
+		Version: 4,
+		Name:    "snapshots_compacted",
+		Up: func(tx *sql.Tx) error {
+			_, err := addColumnIfMissing(tx, "snapshots", "compacted", "INTEGER NOT NULL DEFAULT 0")
+			return err
+		},
+	},
+}
+
+func addColumnIfMissing(tx *sql.Tx, table, column, decl string) (bool, error) {
+	var n int
+	err := tx.QueryRow(`
+		SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?
+	`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return false, err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
+	return err == nil, err
+}
+
+// migrations returns every migration of a backend in version order
+func migrations(d *dialect) ([]Migration, error) {
+	all := append([]Migration(nil), d.goMigrations...)
+
+	dir := "migrations/" + d.migrations + "/"
+	files, err := fs.Glob(migrationFiles, dir+"*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range files {
+		base := strings.TrimSuffix(strings.TrimPrefix(path, dir), ".sql")
+		num, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: want NNNN_name.sql", path)
+		}
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", path, err)
+		}
+
+		body, err := migrationFiles.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		all = append(all, Migration{Version: version, Name: name, SQL: string(body)})
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	for i := 1; i < len(all); i++ {
+		if all[i].Version == all[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d", all[i].Version)
+		}
+	}
+
+	return all, nil
+}
+
+// SchemaVersion is the highest applied migration, 0 for a fresh database
+func (s *sqlStore) SchemaVersion() (int, error) {
+	var exists int
+	err := s.QueryRow(s.d.tableExists, "schema_migrations").Scan(&exists)
+	if err != nil || exists == 0 {
+		return 0, err
+	}
+
+	var version int
+	err = s.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// Migrate applies every pending migration, each in its own transaction,
+// and returns what was (or with dryRun, would be) applied. It refuses to
+// touch a database migrated by a newer binary.
+func (s *sqlStore) Migrate(dryRun bool) ([]Migration, error) {
+	all, err := migrations(s.d)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	latest := 0
+	if len(all) > 0 {
+		latest = all[len(all)-1].Version
+	}
+	if current > latest {
+		return nil, fmt.Errorf("%w: db at %d, binary knows %d", ErrSchemaTooNew, current, latest)
+	}
+
+	var pending []Migration
+	for _, m := range all {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	if dryRun || len(pending) == 0 {
+		return pending, nil
+	}
+
+	if _, err := s.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at BIGINT NOT NULL
+		);
+	`); err != nil {
+		return nil, err
+	}
+
+	for i, m := range pending {
+		if err := s.applyMigration(m); err != nil {
+			return pending[:i], fmt.Errorf("migration %04d_%s: %w", m.Version, m.Name, err)
+		}
+		fmt.Printf("[db] migrated %s %04d_%s\n", s.d.name, m.Version, m.Name)
+	}
+
+	return pending, nil
+}
+
+func (s *sqlStore) applyMigration(m Migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.SQL != "" {
+		if _, err := tx.Exec(m.SQL); err != nil {
+			return err
+		}
+	}
+	if m.Up != nil {
+		if err := m.Up(tx); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(s.d.rebind(`
+		INSERT INTO schema_migrations (version, name, applied_at)
+		VALUES (?, ?, ?)
+	`), m.Version, m.Name, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PlanMigrations lists pending migrations without applying them
+// (MIGRATE_DRY_RUN=1). A sqlite file is opened read-only.
+func PlanMigrations(driver, dsn string) ([]Migration, error) {
+	if driver != "sqlite" {
+		store, err := OpenStore(driver, dsn)
+		if err != nil {
+			return nil, err
+		}
+		defer store.Close()
+
+		return store.Migrate(true)
+	}
+
+	if _, err := os.Stat(dsn); errors.Is(err, os.ErrNotExist) {
+		return migrations(sqliteDialect)
+	}
+
+	db, err := sql.Open("sqlite", "file:"+dsn+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	store := &sqlStore{db: db, d: sqliteDialect}
+	defer store.Close()
+
+	return store.Migrate(true)
+}
@@ -0,0 +1,109 @@
+-- full schema as of sqlite 0005, later migrations get a file in both dirs
+
+CREATE TABLE IF NOT EXISTS events (
+    id BIGINT NOT NULL,
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    op TEXT NOT NULL,
+    payload BYTEA NOT NULL,
+    layer BIGINT NOT NULL,
+    created_at BIGINT NOT NULL,
+    seq BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS idx_events_room_clock
+ON events(room_id, id);
+
+CREATE INDEX IF NOT EXISTS idx_events_room_layer_seq
+ON events(room_id, layer, seq);
+
+CREATE INDEX IF NOT EXISTS idx_events_room_entity
+ON events(room_id, entity_id);
+
+CREATE TABLE IF NOT EXISTS dom_objects (
+    id TEXT PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    x   DOUBLE PRECISION NOT NULL,
+    y   DOUBLE PRECISION NOT NULL,
+    rot DOUBLE PRECISION NOT NULL,
+    w   DOUBLE PRECISION NOT NULL,
+    h   DOUBLE PRECISION NOT NULL,
+    layer BIGINT NOT NULL,
+    payload TEXT NOT NULL DEFAULT '',
+    is_removed INTEGER NOT NULL DEFAULT 0,
+
+    created_at BIGINT NOT NULL,
+    updated_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_dom_objects_room
+ON dom_objects(room_id);
+
+CREATE INDEX IF NOT EXISTS idx_dom_objects_room_active
+ON dom_objects(room_id, is_removed);
+
+CREATE TABLE IF NOT EXISTS rooms (
+    room_id TEXT PRIMARY KEY,
+    owner_id TEXT NOT NULL,
+    public INTEGER NOT NULL DEFAULT 1,
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS layers (
+    layer_index BIGINT NOT NULL,
+    room_id TEXT NOT NULL,
+    owner_id TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    public INTEGER NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL,
+
+    PRIMARY KEY (room_id, layer_index)
+);
+
+CREATE TABLE IF NOT EXISTS users_layers (
+    room_id TEXT NOT NULL,
+    layer_index BIGINT NOT NULL,
+    user_id TEXT NOT NULL,
+
+    PRIMARY KEY (room_id, layer_index, user_id),
+    FOREIGN KEY (room_id, layer_index)
+        REFERENCES layers(room_id, layer_index)
+        ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_users_layers_user
+ON users_layers(user_id);
+
+CREATE TABLE IF NOT EXISTS users_data (
+    user_id TEXT PRIMARY KEY,
+    role INTEGER NOT NULL DEFAULT 0,
+
+    name TEXT NOT NULL DEFAULT '',
+    given_name TEXT NOT NULL DEFAULT '',
+    email TEXT NOT NULL DEFAULT '',
+
+    created_at BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users_rooms (
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    role INTEGER NOT NULL DEFAULT 0,
+    joined_at BIGINT NOT NULL,
+    PRIMARY KEY (user_id, room_id)
+);
+
+CREATE TABLE IF NOT EXISTS snapshots (
+    room_id TEXT NOT NULL,
+    layer BIGINT NOT NULL,
+    seq BIGINT NOT NULL,
+    clock BIGINT NOT NULL,
+    strokes BYTEA NOT NULL,
+    doms BYTEA NOT NULL,
+    compacted INTEGER NOT NULL DEFAULT 0,
+    created_at BIGINT NOT NULL,
+    PRIMARY KEY (room_id, layer, seq)
+);
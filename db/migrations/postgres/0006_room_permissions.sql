@@ -0,0 +1,8 @@
+-- per room overrides of config.DefaultPermissions, op is an operation,
+-- a family like "dom-*" or "*"
+CREATE TABLE IF NOT EXISTS room_permissions (
+    room_id TEXT NOT NULL,
+    op TEXT NOT NULL,
+    role INTEGER NOT NULL,
+    PRIMARY KEY (room_id, op)
+);
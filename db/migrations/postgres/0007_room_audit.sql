@@ -0,0 +1,12 @@
+-- who created, joined or was added to a room, written next to the change
+CREATE TABLE IF NOT EXISTS room_audit (
+    room_id TEXT NOT NULL,
+    actor_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    action TEXT NOT NULL,
+    role INTEGER NOT NULL,
+    created_at BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_room_audit_room
+ON room_audit(room_id, created_at);
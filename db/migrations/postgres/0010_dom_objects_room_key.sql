@@ -0,0 +1,7 @@
+-- dom ids come from clients, so they are only unique within a room; key the
+-- table on both so an add in one room can not touch another room's object
+ALTER TABLE dom_objects DROP CONSTRAINT dom_objects_pkey;
+ALTER TABLE dom_objects ADD PRIMARY KEY (room_id, id);
+
+-- the primary key covers room_id lookups now
+DROP INDEX IF EXISTS idx_dom_objects_room;
@@ -0,0 +1,17 @@
+CREATE INDEX IF NOT EXISTS idx_events_room_layer_seq
+ON events(room_id, layer, seq);
+
+CREATE INDEX IF NOT EXISTS idx_events_room_entity
+ON events(room_id, entity_id);
+
+-- compacted is added by 0004, some databases already have this table
+CREATE TABLE IF NOT EXISTS snapshots (
+    room_id TEXT NOT NULL,
+    layer INTEGER NOT NULL,
+    seq INTEGER NOT NULL,
+    clock INTEGER NOT NULL,
+    strokes BLOB NOT NULL,
+    doms BLOB NOT NULL,
+    created_at INTEGER NOT NULL,
+    PRIMARY KEY (room_id, layer, seq)
+);
@@ -0,0 +1,43 @@
+-- dom_objects.layer was declared INTEGET, sqlite can only change a column
+-- type by rebuilding the table
+
+CREATE TABLE dom_objects_new (
+    id TEXT PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    x   REAL NOT NULL,
+    y   REAL NOT NULL,
+    rot REAL NOT NULL,
+    w   REAL NOT NULL,
+    h   REAL NOT NULL,
+    layer INTEGER NOT NULL,
+    payload TEXT NOT NULL DEFAULT '',
+    is_removed INTEGER NOT NULL DEFAULT 0,
+
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL
+);
+
+INSERT INTO dom_objects_new (
+    id, room_id, user_id, kind,
+    x, y, rot, w, h,
+    layer, payload, is_removed,
+    created_at, updated_at
+)
+SELECT
+    id, room_id, user_id, kind,
+    x, y, rot, w, h,
+    layer, payload, is_removed,
+    created_at, updated_at
+FROM dom_objects;
+
+DROP TABLE dom_objects;
+
+ALTER TABLE dom_objects_new RENAME TO dom_objects;
+
+CREATE INDEX idx_dom_objects_room
+ON dom_objects(room_id);
+
+CREATE INDEX idx_dom_objects_room_active
+ON dom_objects(room_id, is_removed);
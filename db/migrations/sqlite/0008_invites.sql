@@ -0,0 +1,16 @@
+-- invite links, the signed token carries the same room, role and expiry
+-- but uses and revocation only live here. max_uses 0 is unlimited.
+CREATE TABLE IF NOT EXISTS invites (
+    id TEXT PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    role INTEGER NOT NULL,
+    created_by TEXT NOT NULL,
+    max_uses INTEGER NOT NULL DEFAULT 0,
+    uses INTEGER NOT NULL DEFAULT 0,
+    revoked INTEGER NOT NULL DEFAULT 0,
+    expires_at INTEGER NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invites_room
+ON invites(room_id);
@@ -0,0 +1,2 @@
+-- public rooms can let viewers in without an account, they only watch
+ALTER TABLE rooms ADD COLUMN anonymous INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,42 @@
+-- dom ids come from clients, so they are only unique within a room; key the
+-- table on both so an add in one room can not touch another room's object
+
+CREATE TABLE dom_objects_new (
+    id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    x   REAL NOT NULL,
+    y   REAL NOT NULL,
+    rot REAL NOT NULL,
+    w   REAL NOT NULL,
+    h   REAL NOT NULL,
+    layer INTEGER NOT NULL,
+    payload TEXT NOT NULL DEFAULT '',
+    is_removed INTEGER NOT NULL DEFAULT 0,
+
+    created_at INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL,
+
+    PRIMARY KEY (room_id, id)
+);
+
+INSERT INTO dom_objects_new (
+    id, room_id, user_id, kind,
+    x, y, rot, w, h,
+    layer, payload, is_removed,
+    created_at, updated_at
+)
+SELECT
+    id, room_id, user_id, kind,
+    x, y, rot, w, h,
+    layer, payload, is_removed,
+    created_at, updated_at
+FROM dom_objects;
+
+DROP TABLE dom_objects;
+
+ALTER TABLE dom_objects_new RENAME TO dom_objects;
+
+CREATE INDEX idx_dom_objects_room_active
+ON dom_objects(room_id, is_removed);
@@ -0,0 +1,85 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// GetRoomPermissions returns the overrides of a room only, merge them with
+// config.DefaultPermissions before checking an operation.
+func (s *sqlStore) GetRoomPermissions(roomId string) (config.Permissions, error) {
+	return roomPermissions(s, roomId)
+}
+
+func roomPermissions(q queryer, roomId string) (config.Permissions, error) {
+	rows, err := q.Query(`
+		SELECT op, role
+		FROM room_permissions
+		WHERE room_id = ?
+	`, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	perms := config.Permissions{}
+	for rows.Next() {
+		var op string
+		var role int
+		if err := rows.Scan(&op, &role); err != nil {
+			return nil, err
+		}
+		perms[op] = config.IntToRole(role)
+	}
+
+	return perms, rows.Err()
+}
+
+// SetRoomPermissions replaces every override of the room, an empty set goes
+// back to the defaults.
+func SetRoomPermissions(roomId string, perms config.Permissions) error {
+	if W == nil {
+		return fmt.Errorf("writer not initialized")
+	}
+
+	result := make(chan error, 1)
+
+	err := W.enqueue(DbJob{
+		Type: OpRoomPermissions,
+		Permissions: config.PermissionsEvent{
+			RoomID:      roomId,
+			Permissions: perms,
+			Result:      result,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return <-result
+}
+
+func (w *Writer) setRoomPermissions(j config.PermissionsEvent) error {
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM room_permissions WHERE room_id = ?`, j.RoomID); err != nil {
+		return err
+	}
+
+	for op, role := range j.Permissions {
+		_, err := tx.Exec(`
+			INSERT INTO room_permissions (room_id, op, role)
+			VALUES (?, ?, ?)
+		`, j.RoomID, op, int(role))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,331 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// Snapshots cut the events table by seq (write order) instead of by clock:
+// a stroke gets its clock on stroke-start but is only written on stroke-end,
+// so clock order and write order differ.
+
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func CreateSnapshot(roomId string, layer int64, compact bool) error {
+	if W == nil {
+		return fmt.Errorf("writer not initialized")
+	}
+
+	result := make(chan error, 1)
+
+	err := W.enqueue(DbJob{
+		Type: OpSnapshot,
+		Snapshot: config.SnapshotEvent{
+			RoomID:  roomId,
+			Layer:   layer,
+			Compact: compact,
+			Result:  result,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return <-result
+}
+
+// runs inside writerLoop, so no other write can land between the reads
+func (w *Writer) buildSnapshot(j config.SnapshotEvent) error {
+	tx, err := w.store.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	seq := w.seq
+	var clock int64
+
+	base, err := latestSnapshot(tx, j.RoomID, j.Layer)
+	if err != nil {
+		return err
+	}
+
+	var strokes []config.Event
+	var from int64
+	if base != nil {
+		strokes = base.Strokes
+		from = base.Seq
+		clock = base.Clock
+	}
+
+	if seq <= from {
+		// nothing new since the last snapshot
+		return nil
+	}
+
+	tail, err := strokeEventsBetween(tx, j.RoomID, j.Layer, from, seq)
+	if err != nil {
+		return err
+	}
+	strokes = ApplyStrokeEvents(strokes, tail)
+
+	err = tx.QueryRow(`
+		SELECT `+tx.d.greatest+`(?, COALESCE(MAX(id), 0))
+		FROM events
+		WHERE room_id = ? AND seq <= ?
+	`, clock, j.RoomID, seq).Scan(&clock)
+	if err != nil {
+		return err
+	}
+
+	doms, err := activeDomObjects(tx, j.RoomID, j.Layer)
+	if err != nil {
+		return err
+	}
+
+	strokesRaw, err := json.Marshal(strokes)
+	if err != nil {
+		return err
+	}
+	domsRaw, err := json.Marshal(doms)
+	if err != nil {
+		return err
+	}
+
+	compacted := 0
+	if j.Compact {
+		compacted = 1
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO snapshots (room_id, layer, seq, clock, strokes, doms, compacted, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, j.RoomID, j.Layer, seq, clock, strokesRaw, domsRaw, compacted, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	if j.Compact {
+		// everything up to seq is now carried by the snapshot
+		_, err = tx.Exec(`
+			DELETE FROM events
+			WHERE room_id = ? AND layer = ? AND seq <= ?
+		`, j.RoomID, j.Layer, seq)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			DELETE FROM snapshots
+			WHERE room_id = ? AND layer = ? AND seq < ?
+		`, j.RoomID, j.Layer, seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ApplyStrokeEvents folds stroke-add / stroke-remove events onto base and
+// returns the live strokes ordered by clock.
+func ApplyStrokeEvents(base []config.Event, events []config.Event) []config.Event {
+	live := make(map[string]config.Event, len(base)+len(events))
+	for _, e := range base {
+		live[e.EntityID] = e
+	}
+
+	for _, e := range events {
+		switch e.Op {
+		case "stroke-add":
+			live[e.EntityID] = e
+		case "stroke-remove":
+			delete(live, e.EntityID)
+		}
+	}
+
+	result := make([]config.Event, 0, len(live))
+	for _, e := range live {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, k int) bool {
+		return result[i].ID < result[k].ID
+	})
+
+	return result
+}
+
+func (s *sqlStore) GetLatestSnapshot(roomID string, layer int64) (*config.Snapshot, error) {
+	return latestSnapshot(s, roomID, layer)
+}
+
+func latestSnapshot(q queryer, roomID string, layer int64) (*config.Snapshot, error) {
+	return snapshotUpTo(q, roomID, layer, -1)
+}
+
+// GetCompactedClock returns the clock up to which events of a layer were
+// pruned, 0 when the log is complete.
+func (s *sqlStore) GetCompactedClock(roomID string, layer int64) (int64, error) {
+	var clock int64
+
+	err := s.QueryRow(`
+		SELECT COALESCE(MAX(clock), 0)
+		FROM snapshots
+		WHERE room_id = ? AND layer = ? AND compacted = 1
+	`, roomID, layer).Scan(&clock)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return clock, nil
+}
+
+// GetStrokeState returns the live strokes of a layer: latest snapshot plus
+// every stroke event written after it.
+func (s *sqlStore) GetStrokeState(roomID string, layer int64) ([]config.Event, int64, error) {
+	snap, err := s.GetLatestSnapshot(roomID, layer)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var base []config.Event
+	var from, clock int64
+	if snap != nil {
+		base = snap.Strokes
+		from = snap.Seq
+		clock = snap.Clock
+	}
+
+	tail, err := strokeEventsBetween(s, roomID, layer, from, -1)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ApplyStrokeEvents(base, tail), clock, nil
+}
+
+// to < 0 means no upper bound
+func strokeEventsBetween(q queryer, roomID string, layer int64, from int64, to int64) ([]config.Event, error) {
+	rows, err := q.Query(`
+        SELECT id, room_id, user_id, entity_id, op, payload, layer, created_at
+        FROM events
+        WHERE room_id = ? AND layer = ?
+        AND op IN ('stroke-add', 'stroke-remove')
+        AND seq > ? AND (CAST(? AS BIGINT) < 0 OR seq <= ?)
+        ORDER BY seq ASC
+    `, roomID, layer, from, to, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []config.Event{}
+
+	for rows.Next() {
+		var e config.Event
+		if err := rows.Scan(
+			&e.ID, &e.RoomID, &e.UserID, &e.EntityID, &e.Op, &e.Payload, &e.LayerIndex, &e.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func activeDomObjects(q queryer, roomID string, layer int64) ([]config.DomObjectNetwork, error) {
+	rows, err := q.Query(`
+        SELECT
+            id, kind, x, y, rot, w, h , payload , layer
+        FROM dom_objects
+        WHERE room_id = ?
+        AND is_removed = 0
+		AND layer = ?
+    `, roomID, layer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []config.DomObjectNetwork
+
+	for rows.Next() {
+		var dom config.DomObjectNetwork
+		var t config.Transform
+
+		err := rows.Scan(
+			&dom.ID, &dom.Kind,
+			&t.X, &t.Y, &t.Rot, &t.W, &t.H, &dom.Payload, &dom.LayerIndex,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		dom.Transform = t
+		result = append(result, dom)
+	}
+
+	return result, nil
+}
+
+// GetSnapshotTargets lists room layers with at least minEvents events
+// written since their latest snapshot.
+func (s *sqlStore) GetSnapshotTargets(minEvents int) ([]config.Layer, error) {
+	rows, err := s.Query(`
+		SELECT e.room_id, e.layer
+		FROM events e
+		LEFT JOIN (
+			SELECT room_id, layer, MAX(seq) AS seq
+			FROM snapshots
+			GROUP BY room_id, layer
+		) s ON s.room_id = e.room_id AND s.layer = e.layer
+		WHERE e.seq > COALESCE(s.seq, 0)
+		GROUP BY e.room_id, e.layer
+		HAVING COUNT(*) >= ?
+	`, minEvents)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var targets []config.Layer
+	for rows.Next() {
+		var l config.Layer
+		if err := rows.Scan(&l.RoomID, &l.Index); err != nil {
+			return nil, err
+		}
+		targets = append(targets, l)
+	}
+
+	return targets, rows.Err()
+}
+
+func StartSnapshotter(interval time.Duration, minEvents int, compact bool) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for range ticker.C {
+			targets, err := GetSnapshotTargets(minEvents)
+			if err != nil {
+				fmt.Printf("DB Error (Snapshot Targets): %v\n", err)
+				continue
+			}
+
+			for _, t := range targets {
+				if err := CreateSnapshot(t.RoomID, t.Index, compact); err != nil {
+					fmt.Printf("DB Error (Snapshot %s/%d): %v\n", t.RoomID, t.Index, err)
+				}
+			}
+		}
+	}()
+}
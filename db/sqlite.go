@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var sqliteDialect = &dialect{
+	name:         "sqlite",
+	greatest:     "MAX",
+	migrations:   "sqlite",
+	goMigrations: sqliteGoMigrations,
+	tableExists: `
+		SELECT COUNT(*) FROM sqlite_master
+		WHERE type = 'table' AND name = ?
+	`,
+	isRetryable: isBusy,
+}
+
+type SQLiteStore struct {
+	sqlStore
+}
+
+func OpenSQLite(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`
+        PRAGMA journal_mode = WAL;
+        PRAGMA synchronous = NORMAL;
+        PRAGMA busy_timeout = 5000; -- Wait 5s if db is locked
+    `); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{sqlStore{db: db, d: sqliteDialect}}, nil
+}
+
+func isBusy(err error) bool {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return false
+	}
+
+	switch se.Code() & 0xff { // strip extended codes
+	case sqlite3.SQLITE_BUSY, sqlite3.SQLITE_LOCKED:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// ErrCompacted means the events needed to go back to a clock were pruned
+var ErrCompacted = errors.New("events before this clock were compacted")
+
+// GetLayerStateAt returns the live strokes and dom objects of a layer as
+// they were at clock, clock <= 0 is now.
+func (s *sqlStore) GetLayerStateAt(roomID string, layer int64, clock int64) ([]config.Event, []config.DomObjectNetwork, error) {
+	if clock <= 0 {
+		strokes, _, err := s.GetStrokeState(roomID, layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		doms, err := activeDomObjects(s, roomID, layer)
+		return strokes, doms, err
+	}
+
+	compacted, err := s.GetCompactedClock(roomID, layer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if clock < compacted {
+		return nil, nil, ErrCompacted
+	}
+
+	snap, err := snapshotUpTo(s, roomID, layer, clock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var strokes []config.Event
+	var doms []config.DomObjectNetwork
+	var from int64
+	if snap != nil {
+		strokes = snap.Strokes
+		doms = snap.Doms
+		from = snap.Seq
+	}
+
+	tail, err := eventsUpTo(s, roomID, layer, from, clock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ApplyStrokeEvents(strokes, tail), ApplyDomEvents(doms, tail), nil
+}
+
+// GetClockAt is the room clock at ts (unix ms), the last event written at or
+// before it. Snapshots count too since compaction prunes their events.
+func (s *sqlStore) GetClockAt(roomID string, ts int64) (int64, error) {
+	var clock int64
+
+	err := s.QueryRow(`
+		SELECT `+s.d.greatest+`(
+			COALESCE((SELECT MAX(id) FROM events WHERE room_id = ? AND created_at <= ?), 0),
+			COALESCE((SELECT MAX(clock) FROM snapshots WHERE room_id = ? AND created_at <= ?), 0)
+		)
+	`, roomID, ts, roomID, ts).Scan(&clock)
+	if err != nil {
+		return 0, err
+	}
+
+	return clock, nil
+}
+
+// ApplyDomEvents folds dom-add / dom-transform / dom-remove events onto
+// base, keeping creation order. Payload edits are not evented, a dom keeps
+// the payload it was added with.
+func ApplyDomEvents(base []config.DomObjectNetwork, events []config.Event) []config.DomObjectNetwork {
+	live := make([]*config.DomObjectNetwork, 0, len(base))
+	index := make(map[string]int, len(base))
+	for i := range base {
+		d := base[i]
+		index[d.ID] = len(live)
+		live = append(live, &d)
+	}
+
+	for _, e := range events {
+		if e.Op != "dom-add" && e.Op != "dom-transform" && e.Op != "dom-remove" {
+			continue
+		}
+
+		var m config.NetworkMsg
+		if err := json.Unmarshal(e.Payload, &m); err != nil {
+			continue
+		}
+
+		i, ok := index[e.EntityID]
+		switch e.Op {
+		case "dom-add":
+			if m.DomObject == nil {
+				continue
+			}
+			d := *m.DomObject
+			d.ID = e.EntityID
+			if ok {
+				live[i] = &d
+			} else {
+				index[d.ID] = len(live)
+				live = append(live, &d)
+			}
+		case "dom-transform":
+			if ok && live[i] != nil && m.Transform != nil {
+				live[i].Transform = *m.Transform
+			}
+		case "dom-remove":
+			if ok {
+				live[i] = nil
+			}
+		}
+	}
+
+	result := make([]config.DomObjectNetwork, 0, len(live))
+	for _, d := range live {
+		if d != nil {
+			result = append(result, *d)
+		}
+	}
+	return result
+}
+
+// snapshotUpTo is the latest snapshot taken at or before clock, clock < 0
+// takes the latest one.
+func snapshotUpTo(q queryer, roomID string, layer int64, clock int64) (*config.Snapshot, error) {
+	var snap config.Snapshot
+	var strokesRaw, domsRaw []byte
+
+	err := q.QueryRow(`
+		SELECT room_id, layer, seq, clock, strokes, doms, created_at
+		FROM snapshots
+		WHERE room_id = ? AND layer = ?
+		AND (CAST(? AS BIGINT) < 0 OR clock <= ?)
+		ORDER BY seq DESC
+		LIMIT 1
+	`, roomID, layer, clock, clock).Scan(
+		&snap.RoomID, &snap.Layer, &snap.Seq, &snap.Clock,
+		&strokesRaw, &domsRaw, &snap.CreatedAt,
+	)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(strokesRaw, &snap.Strokes); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(domsRaw, &snap.Doms); err != nil {
+		return nil, err
+	}
+
+	return &snap, nil
+}
+
+// eventsUpTo returns stroke and dom events written after seq from with a
+// clock up to clock, in write order.
+func eventsUpTo(q queryer, roomID string, layer int64, from int64, clock int64) ([]config.Event, error) {
+	rows, err := q.Query(`
+        SELECT id, room_id, user_id, entity_id, op, payload, layer, created_at
+        FROM events
+        WHERE room_id = ? AND layer = ?
+        AND seq > ? AND id <= ?
+        ORDER BY seq ASC
+    `, roomID, layer, from, clock)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []config.Event{}
+
+	for rows.Next() {
+		var e config.Event
+		if err := rows.Scan(
+			&e.ID, &e.RoomID, &e.UserID, &e.EntityID, &e.Op, &e.Payload, &e.LayerIndex, &e.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// Store is a storage backend. Reads go straight to it through the package
+// funcs below, writes are queued on the Writer which drives the unexported
+// methods from its own goroutine.
+type Store interface {
+	Name() string
+	Migrate(dryRun bool) ([]Migration, error)
+	Close() error
+
+	// events and snapshots
+	GetEvent(roomID string, id string, layer int) ([]config.Event, error)
+	GetRemovedSince(roomID string, id int64, layer int64) ([]config.Event, error)
+	GetMaxIdByRoom(roomID string) (int64, error)
+	GetLatestSnapshot(roomID string, layer int64) (*config.Snapshot, error)
+	GetCompactedClock(roomID string, layer int64) (int64, error)
+	GetStrokeState(roomID string, layer int64) ([]config.Event, int64, error)
+	GetSnapshotTargets(minEvents int) ([]config.Layer, error)
+	GetLayerStateAt(roomID string, layer int64, clock int64) ([]config.Event, []config.DomObjectNetwork, error)
+	GetClockAt(roomID string, ts int64) (int64, error)
+
+	// dom objects
+	GetActiveDomObjects(roomID string, layer int64) ([]config.DomObjectNetwork, error)
+	GetDomObject(roomID string, id string) (config.DomObjectNetwork, bool, error)
+
+	// rooms
+	CheckRoomExisted(roomId string) (bool, error)
+	CheckCanViewRoom(roomId string, userId string) (ViewResult, error)
+	CheckcanEditRoom(roomId string, userId string) (ViewResult, error)
+	GetRoomAccess(roomId string, userId string) (RoomAccess, error)
+	GetAllRooms(userId string) ([]config.RoomEvent, error)
+	GetAllAreaWithPerm(roomId string, userId string) ([]config.Area, error)
+	GetRoomPermissions(roomId string) (config.Permissions, error)
+	GetRoomInvites(roomId string) ([]config.Invite, error)
+
+	// layers
+	CheckCanUseLayer(roomId string, layerIndex int64, userId string) (bool, error)
+	GetRoomLayers(roomId string) ([]config.Layer, error)
+	GetLayerByUserId(userId string, roomId string) (int64, error)
+
+	// users and memberships
+	CheckRegister(userId string) (ViewResult, error)
+	GetUserIDByEmail(email string) (string, error)
+	GetUserRole(userId string) (int, error)
+	GetUserRoomRole(roomId string, userId string) (int64, error)
+	GetAllUserInRoom(roomId string) ([]config.UserEvent, error)
+
+	// archives, see export.go
+	ExportRoom(roomID string) (*config.RoomArchive, error)
+
+	// writer side
+	maxSeq() (int64, error)
+	prepare() (*stmts, error)
+	begin() (*storeTx, error)
+	retryable(err error) bool
+}
+
+// dialect is everything that differs between the sql backends, queries
+// are written with ? placeholders and rebound per backend.
+type dialect struct {
+	name       string
+	numbered   bool   // $1, $2 ... instead of ?
+	greatest   string // scalar max of two values
+	migrations string // dir under migrations/
+	// Go steps merged with the .sql files, see migrate.go
+	goMigrations []Migration
+	tableExists  string // one param: table name
+	isRetryable  func(err error) bool
+}
+
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+
+	n := 0
+	inString := false
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'':
+			inString = !inString
+			b.WriteByte(c)
+		case c == '?' && !inString:
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// sqlStore implements Store on database/sql, see sqlite.go and postgres.go
+type sqlStore struct {
+	db *sql.DB
+	d  *dialect
+}
+
+func (s *sqlStore) Name() string { return s.d.name }
+
+func (s *sqlStore) Close() error { return s.db.Close() }
+
+func (s *sqlStore) Query(query string, args ...any) (*sql.Rows, error) {
+	return s.db.Query(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) QueryRow(query string, args ...any) *sql.Row {
+	return s.db.QueryRow(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) Exec(query string, args ...any) (sql.Result, error) {
+	return s.db.Exec(s.d.rebind(query), args...)
+}
+
+func (s *sqlStore) Prepare(query string) (*sql.Stmt, error) {
+	return s.db.Prepare(s.d.rebind(query))
+}
+
+func (s *sqlStore) maxSeq() (int64, error) {
+	var seq int64
+	err := s.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM events`).Scan(&seq)
+	return seq, err
+}
+
+func (s *sqlStore) begin() (*storeTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &storeTx{tx: tx, d: s.d}, nil
+}
+
+func (s *sqlStore) retryable(err error) bool {
+	return s.d.isRetryable != nil && s.d.isRetryable(err)
+}
+
+// storeTx rebinds like sqlStore so the same helpers run in and out of a tx
+type storeTx struct {
+	tx *sql.Tx
+	d  *dialect
+}
+
+func (t *storeTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return t.tx.Query(t.d.rebind(query), args...)
+}
+
+func (t *storeTx) QueryRow(query string, args ...any) *sql.Row {
+	return t.tx.QueryRow(t.d.rebind(query), args...)
+}
+
+func (t *storeTx) Exec(query string, args ...any) (sql.Result, error) {
+	return t.tx.Exec(t.d.rebind(query), args...)
+}
+
+func (t *storeTx) Commit() error   { return t.tx.Commit() }
+func (t *storeTx) Rollback() error { return t.tx.Rollback() }
+
+// StoreConfigFromEnv reads DB_DRIVER (sqlite by default) and DATABASE_URL,
+// sqlite falls back to the file on the Fly volume.
+func StoreConfigFromEnv() (driver string, dsn string) {
+	driver = os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = "sqlite"
+	}
+
+	dsn = os.Getenv("DATABASE_URL")
+	if dsn == "" && driver == "sqlite" {
+		dsn = "./data/events.db"
+	}
+	return driver, dsn
+}
+
+func OpenStore(driver, dsn string) (Store, error) {
+	switch driver {
+	case "sqlite":
+		s, err := OpenSQLite(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	case "postgres":
+		s, err := OpenPostgres(dsn)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown db driver %q", driver)
+}
+
+// --- Package Reads (through the writer's store) ---
+
+func GetEvent(roomID string, id string, layer int) ([]config.Event, error) {
+	return W.store.GetEvent(roomID, id, layer)
+}
+
+func GetRemovedSince(roomID string, id int64, layer int64) ([]config.Event, error) {
+	return W.store.GetRemovedSince(roomID, id, layer)
+}
+
+func GetMaxIdByRoom(roomID string) (int64, error) {
+	return W.store.GetMaxIdByRoom(roomID)
+}
+
+func GetLatestSnapshot(roomID string, layer int64) (*config.Snapshot, error) {
+	return W.store.GetLatestSnapshot(roomID, layer)
+}
+
+func GetCompactedClock(roomID string, layer int64) (int64, error) {
+	return W.store.GetCompactedClock(roomID, layer)
+}
+
+func GetStrokeState(roomID string, layer int64) ([]config.Event, int64, error) {
+	return W.store.GetStrokeState(roomID, layer)
+}
+
+func GetSnapshotTargets(minEvents int) ([]config.Layer, error) {
+	return W.store.GetSnapshotTargets(minEvents)
+}
+
+func GetLayerStateAt(roomID string, layer int64, clock int64) ([]config.Event, []config.DomObjectNetwork, error) {
+	return W.store.GetLayerStateAt(roomID, layer, clock)
+}
+
+func GetClockAt(roomID string, ts int64) (int64, error) {
+	return W.store.GetClockAt(roomID, ts)
+}
+
+func GetActiveDomObjects(roomID string, layer int64) ([]config.DomObjectNetwork, error) {
+	return W.store.GetActiveDomObjects(roomID, layer)
+}
+
+func GetDomObject(roomID string, id string) (config.DomObjectNetwork, bool, error) {
+	return W.store.GetDomObject(roomID, id)
+}
+
+func CheckRoomExisted(roomId string) (bool, error) {
+	return W.store.CheckRoomExisted(roomId)
+}
+
+func CheckCanViewRoom(roomId string, userId string) (ViewResult, error) {
+	return W.store.CheckCanViewRoom(roomId, userId)
+}
+
+func CheckcanEditRoom(roomId string, userId string) (ViewResult, error) {
+	return W.store.CheckcanEditRoom(roomId, userId)
+}
+
+func GetRoomAccess(roomId string, userId string) (RoomAccess, error) {
+	return W.store.GetRoomAccess(roomId, userId)
+}
+
+func GetAllRooms(userId string) ([]config.RoomEvent, error) {
+	return W.store.GetAllRooms(userId)
+}
+
+func GetAllAreaWithPerm(roomId string, userId string) ([]config.Area, error) {
+	return W.store.GetAllAreaWithPerm(roomId, userId)
+}
+
+func GetRoomPermissions(roomId string) (config.Permissions, error) {
+	return W.store.GetRoomPermissions(roomId)
+}
+
+func GetRoomInvites(roomId string) ([]config.Invite, error) {
+	return W.store.GetRoomInvites(roomId)
+}
+
+func CheckCanUseLayer(roomId string, layerIndex int64, userId string) (bool, error) {
+	return W.store.CheckCanUseLayer(roomId, layerIndex, userId)
+}
+
+func GetRoomLayers(roomId string) ([]config.Layer, error) {
+	return W.store.GetRoomLayers(roomId)
+}
+
+func GetLayerByUserId(userId string, roomId string) (int64, error) {
+	return W.store.GetLayerByUserId(userId, roomId)
+}
+
+func CheckRegister(userId string) (ViewResult, error) {
+	return W.store.CheckRegister(userId)
+}
+
+func GetUserIDByEmail(email string) (string, error) {
+	return W.store.GetUserIDByEmail(email)
+}
+
+func GetUserRole(userId string) (int, error) {
+	return W.store.GetUserRole(userId)
+}
+
+func GetUserRoomRole(roomId string, userId string) (int64, error) {
+	return W.store.GetUserRoomRole(roomId, userId)
+}
+
+func GetAllUserInRoom(roomId string) ([]config.UserEvent, error) {
+	return W.store.GetAllUserInRoom(roomId)
+}
+
+func ExportRoom(roomID string) (*config.RoomArchive, error) {
+	return W.store.ExportRoom(roomID)
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"none", `SELECT 1`, `SELECT 1`},
+		{"in order", `WHERE a = ? AND b = ?`, `WHERE a = $1 AND b = $2`},
+		{"values", `VALUES (?, ?, ?)`, `VALUES ($1, $2, $3)`},
+		{"string literal", `WHERE a = '?' AND b = ?`, `WHERE a = '?' AND b = $1`},
+		{"escaped quote", `WHERE a = 'it''s ?' AND b = ?`, `WHERE a = 'it''s ?' AND b = $1`},
+		{"upsert", `VALUES (?) ON CONFLICT(id) DO UPDATE SET x = ?`, `VALUES ($1) ON CONFLICT(id) DO UPDATE SET x = $2`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postgresDialect.rebind(tt.query); got != tt.want {
+				t.Fatalf("postgres rebind = %q, want %q", got, tt.want)
+			}
+			if got := sqliteDialect.rebind(tt.query); got != tt.query {
+				t.Fatalf("sqlite rebind changed the query to %q", got)
+			}
+		})
+	}
+}
+
+// testStores opens every backend the conformance test can reach, postgres
+// only when PG_DSN points at a database it may write to
+func testStores(t *testing.T) map[string]func(t *testing.T) Store {
+	stores := map[string]func(t *testing.T) Store{
+		"sqlite": func(t *testing.T) Store { return OpenTestStore(t) },
+	}
+
+	if dsn := os.Getenv("PG_DSN"); dsn != "" {
+		stores["postgres"] = func(t *testing.T) Store {
+			store, err := OpenStore("postgres", dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			startTestWriter(t, store)
+			return store
+		}
+	}
+	return stores
+}
+
+func flush(t *testing.T) {
+	t.Helper()
+	if err := Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreConformance(t *testing.T) {
+	for name, open := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			open(t)
+
+			// postgres keeps rows between runs
+			id := func(s string) string { return fmt.Sprintf("%s-%d", s, time.Now().UnixNano()) }
+			room, owner, member, invited := id("room"), id("owner"), id("member"), id("invited")
+
+			t.Run("user upsert", func(t *testing.T) {
+				if err := CreateUser(owner, config.RoleMember, "old", "old", owner+"@old"); err != nil {
+					t.Fatal(err)
+				}
+				if err := CreateUser(owner, config.RoleOwner, "new", "new", owner+"@new"); err != nil {
+					t.Fatal(err)
+				}
+				flush(t)
+
+				role, err := GetUserRole(owner)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if role != int(config.RoleOwner) {
+					t.Fatalf("role %d after the upsert, want %d", role, config.RoleOwner)
+				}
+				if got, err := GetUserIDByEmail(owner + "@new"); err != nil || got != owner {
+					t.Fatalf("email lookup %q (%v), want %q", got, err, owner)
+				}
+			})
+
+			t.Run("membership upsert", func(t *testing.T) {
+				if err := CreateRoomAs(room, owner, true); err != nil {
+					t.Fatal(err)
+				}
+				// GetAllUserInRoom lists registered users only
+				if err := CreateUser(member, config.RoleMember, "m", "m", member+"@m"); err != nil {
+					t.Fatal(err)
+				}
+				if err := JoinRoom(room, member, config.RoleGuest); err != nil {
+					t.Fatal(err)
+				}
+				if err := JoinRoom(room, member, config.RoleModerator); err != nil {
+					t.Fatal(err)
+				}
+				flush(t)
+
+				if role, err := GetUserRoomRole(room, member); err != nil || role != int64(config.RoleModerator) {
+					t.Fatalf("room role %d (%v), want %d", role, err, config.RoleModerator)
+				}
+				users, err := GetAllUserInRoom(room)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows := 0
+				for _, u := range users {
+					if u.UserID == member {
+						rows++
+					}
+				}
+				if rows != 1 {
+					t.Fatalf("%d membership rows, want 1", rows)
+				}
+			})
+
+			t.Run("dom upsert", func(t *testing.T) {
+				dom := func(x float64) config.DomEvent {
+					return config.DomEvent{
+						DomObjectNetwork: config.DomObjectNetwork{
+							ID:        id("dom"),
+							Kind:      "img",
+							Transform: config.Transform{X: x, W: 10, H: 10},
+							Payload:   "https://example.com/a.png",
+						},
+						RoomID:    room,
+						UserID:    owner,
+						CreatedAt: 1,
+						UpdatedAt: 1,
+					}
+				}
+				d := dom(1)
+				WriteDom(d, OpDomCreate)
+				d.Transform.X = 5
+				WriteDom(d, OpDomCreate)
+				flush(t)
+
+				doms, err := GetActiveDomObjects(room, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(doms) != 1 || doms[0].Transform.X != 5 {
+					t.Fatalf("doms %+v, want one at x 5", doms)
+				}
+
+				// a create on a removed id brings it back
+				RemoveDom(d.ID, room)
+				flush(t)
+				if doms, _ := GetActiveDomObjects(room, 0); len(doms) != 0 {
+					t.Fatalf("%d doms after the remove, want 0", len(doms))
+				}
+				WriteDom(d, OpDomCreate)
+				flush(t)
+				if _, ok, err := GetDomObject(room, d.ID); err != nil || !ok {
+					t.Fatalf("dom not back after a create (%v)", err)
+				}
+			})
+
+			t.Run("dom ids are per room", func(t *testing.T) {
+				other := id("other-room")
+				shared := id("shared-dom")
+				dom := func(roomID string, x float64) config.DomEvent {
+					return config.DomEvent{
+						DomObjectNetwork: config.DomObjectNetwork{ID: shared, Kind: "img", Transform: config.Transform{X: x}},
+						RoomID:           roomID,
+						UserID:           owner,
+					}
+				}
+
+				WriteDom(dom(room, 1), OpDomCreate)
+				RemoveDom(shared, room)
+				// an add (or redo) in another room with the same id
+				WriteDom(dom(other, 2), OpDomCreate)
+				flush(t)
+
+				if _, ok, err := GetDomObject(room, shared); err != nil || ok {
+					t.Fatalf("removed dom brought back from another room (%v)", err)
+				}
+				d, ok, err := GetDomObject(other, shared)
+				if err != nil || !ok || d.Transform.X != 2 {
+					t.Fatalf("other room dom %+v %v (%v), want it at x 2", d, ok, err)
+				}
+
+				WriteDom(dom(room, 3), OpDomCreate)
+				flush(t)
+				if d, _, _ := GetDomObject(other, shared); d.Transform.X != 2 {
+					t.Fatalf("other room dom moved to x %v", d.Transform.X)
+				}
+			})
+
+			t.Run("events", func(t *testing.T) {
+				writeEvents(t, room, []ev{
+					{1, "stroke-add", "a", 0},
+					{2, "stroke-add", "b", 0},
+					{3, "stroke-remove", "a", 0},
+				})
+
+				events, err := GetEvent(room, "1", 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := entities(events); len(got) != 1 || got[0] != "b" {
+					t.Fatalf("GetEvent = %v, want [b]", got)
+				}
+				if max, err := GetMaxIdByRoom(room); err != nil || max != 3 {
+					t.Fatalf("max id %d (%v), want 3", max, err)
+				}
+			})
+
+			t.Run("invite redeem upsert", func(t *testing.T) {
+				inv := config.Invite{
+					ID:        id("invite"),
+					RoomID:    room,
+					Role:      config.RoleMember,
+					CreatedBy: owner,
+					ExpiresAt: time.Now().Add(time.Hour).UnixMilli(),
+					CreatedAt: time.Now().UnixMilli(),
+				}
+				if err := CreateInvite(inv); err != nil {
+					t.Fatal(err)
+				}
+
+				// a guest already in the room is raised, not added twice
+				if err := JoinRoom(room, invited, config.RoleGuest); err != nil {
+					t.Fatal(err)
+				}
+				role, err := RedeemInvite(inv.ID, invited)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if role != config.RoleMember {
+					t.Fatalf("redeemed as %d, want %d", role, config.RoleMember)
+				}
+				if role, _ := GetUserRoomRole(room, invited); role != int64(config.RoleMember) {
+					t.Fatalf("room role %d, want %d", role, config.RoleMember)
+				}
+
+				// the moderator keeps the higher role and does not use the invite
+				if role, err := RedeemInvite(inv.ID, member); err != nil || role != config.RoleModerator {
+					t.Fatalf("moderator redeemed as %d (%v)", role, err)
+				}
+
+				invites, err := GetRoomInvites(room)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(invites) != 1 || invites[0].Uses != 1 {
+					t.Fatalf("invites %+v, want one used once", invites)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// OpenTestStore opens a migrated sqlite file in a temp dir and starts the
+// writer on it, package reads then go there too. When the test ends the
+// queue is flushed and the store closed.
+func OpenTestStore(t testing.TB) Store {
+	t.Helper()
+
+	store, err := OpenStore("sqlite", filepath.Join(t.TempDir(), "events.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startTestWriter(t, store)
+	return store
+}
+
+func startTestWriter(t testing.TB, store Store) {
+	NewWriter(store, filepath.Join(t.TempDir(), "deadletter.jsonl"))
+	t.Cleanup(func() {
+		Flush()
+		store.Close()
+	})
+}
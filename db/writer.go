@@ -0,0 +1,170 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// how long a producer may block on a full queue before the job is
+	// dead-lettered
+	EnqueueTimeout = 2 * time.Second
+	// attempts for a job that keeps hitting a busy / locked db
+	BusyRetries = 5
+
+	ErrWriterFull = errors.New("db writer queue full")
+)
+
+type WriterStats struct {
+	Enqueued     atomic.Int64 // jobs accepted by the queue
+	Blocked      atomic.Int64 // producers that had to wait for space
+	Written      atomic.Int64 // jobs that reached the db
+	Retried      atomic.Int64 // busy retries
+	Failed       atomic.Int64 // jobs that failed after retries
+	Dropped      atomic.Int64 // jobs that never made it into the queue
+	DeadLettered atomic.Int64 // jobs written to the dead-letter file
+}
+
+var Stats WriterStats
+
+func (s *WriterStats) Snapshot() map[string]int64 {
+	var queued int64
+	if W != nil {
+		queued = int64(len(W.opCh))
+	}
+
+	return map[string]int64{
+		"enqueued":     s.Enqueued.Load(),
+		"blocked":      s.Blocked.Load(),
+		"written":      s.Written.Load(),
+		"retried":      s.Retried.Load(),
+		"failed":       s.Failed.Load(),
+		"dropped":      s.Dropped.Load(),
+		"deadLettered": s.DeadLettered.Load(),
+		"queued":       queued,
+	}
+}
+
+// enqueue waits at most EnqueueTimeout for room in the queue, a job that
+// still does not fit goes to the dead-letter file instead of vanishing.
+func (w *Writer) enqueue(job DbJob) error {
+	select {
+	case w.opCh <- job:
+		Stats.Enqueued.Add(1)
+		return nil
+	default:
+	}
+
+	Stats.Blocked.Add(1)
+	timer := time.NewTimer(EnqueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case w.opCh <- job:
+		Stats.Enqueued.Add(1)
+		return nil
+	case <-timer.C:
+		Stats.Dropped.Add(1)
+		w.deadLetter(job, ErrWriterFull)
+		return ErrWriterFull
+	}
+}
+
+// Flush waits until every job queued before it is written, flush is a
+// barrier so the batch it ends is committed first
+func Flush() error {
+	if W == nil {
+		return fmt.Errorf("writer not initialized")
+	}
+
+	flushed := make(chan struct{})
+	if err := W.enqueue(DbJob{Type: OpFlush, Flushed: flushed}); err != nil {
+		return err
+	}
+	<-flushed
+	return nil
+}
+
+// withRetry runs fn again while the store reports a transient error,
+// SQLITE_BUSY or a postgres serialization failure
+func (w *Writer) withRetry(fn func() error) error {
+	backoff := 50 * time.Millisecond
+
+	var err error
+	for attempt := 0; attempt < BusyRetries; attempt++ {
+		err = fn()
+		if err == nil || !w.store.retryable(err) {
+			return err
+		}
+
+		Stats.Retried.Add(1)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return err
+}
+
+// done records the outcome of a job, jobs whose caller waits on a result
+// channel get the error there and are not dead-lettered.
+func (w *Writer) done(job DbJob, name string, err error) {
+	if err == nil {
+		Stats.Written.Add(1)
+		return
+	}
+
+	Stats.Failed.Add(1)
+	fmt.Printf("DB Error (%s): %v\n", name, err)
+
+	switch job.Type {
+	case OpLayerCreate, OpSnapshot, OpRoomImport, OpRoomPermissions,
+		OpInviteCreate, OpInviteRevoke, OpInviteRedeem, OpRoomAnonymous:
+		return
+	case OpRoomCreate:
+		if job.Room.Result != nil {
+			return
+		}
+	}
+	w.deadLetter(job, err)
+}
+
+type deadLetterEntry struct {
+	At    int64  `json:"at"`
+	Type  int    `json:"type"`
+	Error string `json:"error"`
+	Job   DbJob  `json:"job"`
+}
+
+// deadLetter appends the job as one JSON line so it can be inspected and
+// replayed by hand.
+func (w *Writer) deadLetter(job DbJob, cause error) {
+	line, err := json.Marshal(deadLetterEntry{
+		At:    time.Now().UnixMilli(),
+		Type:  job.Type,
+		Error: cause.Error(),
+		Job:   job,
+	})
+	if err != nil {
+		fmt.Printf("DB Error (Dead Letter): %v\n", err)
+		return
+	}
+
+	w.dlMu.Lock()
+	defer w.dlMu.Unlock()
+
+	f, err := os.OpenFile(w.deadLetterPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Printf("DB Error (Dead Letter): %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		fmt.Printf("DB Error (Dead Letter): %v\n", err)
+		return
+	}
+	Stats.DeadLettered.Add(1)
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"flag"
 	"log"
 	"net/http"
 	"os"
@@ -11,8 +13,11 @@ import (
 
 	"github.com/Tk21111/whiteboard_server/api"
 	"github.com/Tk21111/whiteboard_server/auth"
+	"github.com/Tk21111/whiteboard_server/backup"
+	"github.com/Tk21111/whiteboard_server/bus"
 	"github.com/Tk21111/whiteboard_server/db"
 	"github.com/Tk21111/whiteboard_server/middleware"
+	"github.com/Tk21111/whiteboard_server/thumb"
 	"github.com/Tk21111/whiteboard_server/ws"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -59,9 +64,139 @@ func main() {
 	if err != nil {
 		log.Fatal("failed to create db directory:", err)
 	}
-	db.NewWriter("./data/events.db")
+	// DB_DRIVER=postgres + DATABASE_URL switches off the sqlite file
+	driver, dsn := db.StoreConfigFromEnv()
+
+	// MIGRATE_DRY_RUN=1 lists pending schema migrations and exits
+	if os.Getenv("MIGRATE_DRY_RUN") == "1" {
+		pending, err := db.PlanMigrations(driver, dsn)
+		if err != nil {
+			log.Fatal("failed to plan migrations:", err)
+		}
+		for _, m := range pending {
+			log.Printf("pending migration %04d_%s", m.Version, m.Name)
+		}
+		return
+	}
+
+	// `server restore [-key k] [-clock n]` rebuilds the sqlite file from a
+	// backup, run it with the server stopped
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		fs := flag.NewFlagSet("restore", flag.ExitOnError)
+		key := fs.String("key", "", "backup key, newest when empty")
+		clock := fs.Int64("clock", 0, "drop everything after this clock")
+		fs.Parse(os.Args[2:])
+
+		if driver != "sqlite" {
+			log.Fatal("restore only supports the sqlite driver")
+		}
+		restored, err := backup.Restore(context.Background(), s3Client, backup.ConfigFromEnv(), *key, dsn, *clock)
+		if err != nil {
+			log.Fatal("restore failed:", err)
+		}
+		log.Println("restored", restored, "into", dsn)
+		return
+	}
+
+	store, err := db.OpenStore(driver, dsn)
+	if err != nil {
+		log.Fatal("failed to open db:", err)
+	}
+
+	// `server export -room id [-out file]` writes a room archive, stdout by default
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		fs := flag.NewFlagSet("export", flag.ExitOnError)
+		roomID := fs.String("room", "", "room to export")
+		out := fs.String("out", "", "archive file, stdout when empty")
+		fs.Parse(os.Args[2:])
+
+		if _, err := store.Migrate(false); err != nil {
+			log.Fatal("failed to migrate db:", err)
+		}
+		archive, err := store.ExportRoom(*roomID)
+		if err != nil {
+			log.Fatal("export failed:", err)
+		}
+		if archive == nil {
+			log.Fatal("room not found: ", *roomID)
+		}
+
+		w := os.Stdout
+		if *out != "" {
+			if w, err = os.Create(*out); err != nil {
+				log.Fatal("export failed:", err)
+			}
+			defer w.Close()
+		}
+		if err := json.NewEncoder(w).Encode(archive); err != nil {
+			log.Fatal("export failed:", err)
+		}
+		log.Printf("exported %s: %d events, %d doms, %d objects", *roomID, len(archive.Events), len(archive.Doms), len(archive.ObjectKeys))
+		return
+	}
+	db.NewWriter(store, "./data/deadletter.jsonl")
+
+	// `server import -room new -owner uid (-in file | -from room)` creates a
+	// room from an archive or clones one, run it with the server stopped
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		fs := flag.NewFlagSet("import", flag.ExitOnError)
+		in := fs.String("in", "", "archive file from export")
+		from := fs.String("from", "", "room to clone instead of -in")
+		roomID := fs.String("room", "", "new room id")
+		owner := fs.String("owner", "", "user id of the new owner")
+		layersFlag := fs.String("layers", "", "layers to copy, e.g. 0,2 (all when empty)")
+		keepMembers := fs.Bool("members", false, "keep the other members")
+		fs.Parse(os.Args[2:])
+
+		layers, err := api.ParseLayers(*layersFlag)
+		if err != nil {
+			log.Fatal("invalid -layers:", err)
+		}
+		opts := db.ImportOptions{
+			RoomID:      *roomID,
+			OwnerID:     *owner,
+			Layers:      layers,
+			KeepMembers: *keepMembers,
+		}
+
+		var keys map[string]string
+		if *from != "" {
+			keys, err = db.CloneRoom(*from, opts)
+		} else {
+			keys, err = db.ImportRoomFile(*in, opts)
+		}
+		if err != nil {
+			log.Fatal("import failed:", err)
+		}
+
+		copied := api.CopyObjects(context.Background(), s3Client, keys)
+		log.Printf("imported %s, copied %d/%d objects", *roomID, copied, len(keys))
+		return
+	}
+
+	// BACKUP_INTERVAL=6h uploads online backups next to the uploads
+	if backupCfg := backup.ConfigFromEnv(); backupCfg.Interval > 0 {
+		backup.Start(s3Client, store, backupCfg)
+	}
 	go ws.StartStrokeTTLGC()
 
+	if grace, err := time.ParseDuration(os.Getenv("SLOW_CONSUMER_GRACE")); err == nil {
+		ws.SlowConsumerGrace = grace
+	}
+
+	// BUS_URL=redis://host:6379 shares rooms across instances
+	roomBus, err := bus.FromEnv()
+	if err != nil {
+		log.Fatal("failed to connect bus:", err)
+	}
+	ws.UseBus(roomBus)
+
+	// thumbnails of rooms with activity are redrawn at most this often
+	thumb.Start(30 * time.Second)
+
+	// SNAPSHOT_COMPACT=1 prunes events once a snapshot covers them
+	db.StartSnapshotter(10*time.Minute, 500, os.Getenv("SNAPSHOT_COMPACT") == "1")
+
 	// --------------------------------------------------
 	// ROUTES
 	// --------------------------------------------------
@@ -84,20 +219,22 @@ func main() {
 
 	// --- replay
 	mux.Handle("/get-replay",
-		middleware.RequireSession(api.GetReplay()),
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.GetReplay(), 0),
+		),
 	)
 
 	// --- upload
 	mux.Handle("/upload",
 		middleware.AuthMiddleware(
-			api.UploadHandler(presignClient),
+			middleware.RequireRoomRole(api.UploadHandler(presignClient), 1),
 		),
 	)
 
 	// --- get object
 	mux.Handle("/get",
 		middleware.RequireSession(
-			api.GetObject(presignClient),
+			middleware.RequireRoomRole(api.GetObject(presignClient), 0),
 		),
 	)
 
@@ -105,14 +242,114 @@ func main() {
 		api.GetAllBoardsHandler(),
 	))
 
+	mux.Handle("/thumbnail",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.GetThumbnail(), 0),
+		),
+	)
+
+	// --- render
+	mux.Handle("/render.svg",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.RenderSVG(presignClient), 0),
+		),
+	)
+
+	mux.Handle("/export.pdf",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.ExportPDF(presignClient), 0),
+		),
+	)
+
+	// --- export
+	mux.Handle("/export-room",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.ExportRoom(), 3),
+		),
+	)
+
+	mux.Handle("/import-room",
+		middleware.RequireSession(
+			middleware.RequireRole(api.ImportRoom(s3Client), 2),
+		),
+	)
+
+	mux.Handle("/clone-room",
+		middleware.RequireSession(
+			middleware.RequireRole(api.CloneRoom(s3Client), 2),
+		),
+	)
+
 	// --- room admin
+	mux.Handle("/create-room",
+		middleware.RequireSession(
+			middleware.RequireRole(api.CreateRoom(), 2),
+		),
+	)
+
+	mux.Handle("/join-room",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.JoinRoom(), 0),
+		),
+	)
+
 	mux.Handle("/add-user",
-		middleware.RequireSession(api.OwnerAddUser()),
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.OwnerAddUser(), 3),
+		),
+	)
+
+	// --- invites
+	mux.Handle("/create-invite",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.CreateInvite(), 3),
+		),
+	)
+
+	mux.Handle("/invites",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.ListInvites(), 3),
+		),
+	)
+
+	mux.Handle("/revoke-invite",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.RevokeInvite(), 3),
+		),
+	)
+
+	mux.Handle("/accept-invite",
+		middleware.RequireSession(api.AcceptInvite()),
+	)
+
+	mux.Handle("/room-permissions",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.GetRoomPermissions(), 0),
+		),
+	)
+
+	mux.Handle("/set-room-permissions",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.SetRoomPermissions(), 3),
+		),
+	)
+
+	mux.Handle("/set-room-anonymous",
+		middleware.RequireSession(
+			middleware.RequireRoomRole(api.SetRoomAnonymous(), 3),
+		),
 	)
 
 	mux.Handle("/get-users",
 		middleware.RequireSession(
-			middleware.RequireRole(api.GetAllUserInRoom(), 3),
+			middleware.RequireRoomRole(api.GetAllUserInRoom(), 2),
+		),
+	)
+
+	// --- wire / compression stats
+	mux.Handle("/stats",
+		middleware.RequireSession(
+			middleware.RequireRole(api.GetStats(), 3),
 		),
 	)
 
@@ -0,0 +1,232 @@
+package middleware
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// WebSocket subprotocols, the server prefers binary when the client offers it.
+const (
+	ProtocolBinary = "whiteboard.bin.v1"
+	ProtocolJSON   = "whiteboard.json"
+)
+
+// Binary frame, every int is a varint:
+//
+//	byte     version
+//	uvarint  count
+//	count × {
+//	  varint   clock
+//	  uvarint  len + len bytes of JSON NetworkMsg with the point arrays cut out
+//	  points   msg.Points
+//	  points   msg.Stroke.Points (only when the JSON has a stroke)
+//	}
+//
+// points: uvarint n, then n × zigzag deltas of X, Y (1/PointScale px)
+// and P (1/PressureScale) against the previous point.
+const (
+	binaryVersion = 1
+
+	PointScale    = 100
+	PressureScale = 1000
+)
+
+var ErrBadFrame = errors.New("bad binary frame")
+
+func EncodeBinaryMsg(msgs []config.ServerMsg) ([]byte, error) {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, binaryVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(msgs)))
+
+	for _, m := range msgs {
+		p := m.Payload
+		points := p.Points
+		p.Points = nil
+
+		var strokePoints []config.Point
+		if p.Stroke != nil {
+			s := *p.Stroke
+			strokePoints = s.Points
+			s.Points = nil
+			p.Stroke = &s
+		}
+
+		head, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = binary.AppendVarint(buf, m.Clock)
+		buf = binary.AppendUvarint(buf, uint64(len(head)))
+		buf = append(buf, head...)
+		buf = appendPoints(buf, points)
+		if p.Stroke != nil {
+			buf = appendPoints(buf, strokePoints)
+		}
+	}
+
+	return buf, nil
+}
+
+// DecodeBinaryMsg reads a frame sent by a client, clocks are ignored the
+// same way they are in the JSON path.
+func DecodeBinaryMsg(raw []byte) ([]config.NetworkMsg, error) {
+	msgs, err := DecodeBinaryServerMsg(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]config.NetworkMsg, len(msgs))
+	for i, m := range msgs {
+		res[i] = m.Payload
+	}
+	return res, nil
+}
+
+func DecodeBinaryServerMsg(raw []byte) ([]config.ServerMsg, error) {
+	r := &frameReader{buf: raw}
+
+	if v := r.readByte(); v != binaryVersion {
+		return nil, ErrBadFrame
+	}
+
+	count := r.uvarint()
+	if r.err != nil || count > uint64(len(raw)) {
+		return nil, ErrBadFrame
+	}
+
+	msgs := make([]config.ServerMsg, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var m config.ServerMsg
+
+		m.Clock = r.varint()
+		head := r.bytes(r.uvarint())
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := json.Unmarshal(head, &m.Payload); err != nil {
+			return nil, err
+		}
+
+		m.Payload.Points = r.points()
+		if m.Payload.Stroke != nil {
+			m.Payload.Stroke.Points = r.points()
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+// JSONToBinary re-encodes an already marshalled []config.ServerMsg.
+func JSONToBinary(data []byte) ([]byte, error) {
+	var msgs []config.ServerMsg
+	if err := json.Unmarshal(data, &msgs); err != nil {
+		return nil, err
+	}
+	return EncodeBinaryMsg(msgs)
+}
+
+func appendPoints(buf []byte, points []config.Point) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(points)))
+
+	var px, py, pp int64
+	for _, p := range points {
+		x := int64(math.Round(p.X * PointScale))
+		y := int64(math.Round(p.Y * PointScale))
+		pr := int64(math.Round(p.P * PressureScale))
+
+		buf = binary.AppendVarint(buf, x-px)
+		buf = binary.AppendVarint(buf, y-py)
+		buf = binary.AppendVarint(buf, pr-pp)
+		px, py, pp = x, y, pr
+	}
+
+	return buf
+}
+
+type frameReader struct {
+	buf []byte
+	err error
+}
+
+func (r *frameReader) readByte() byte {
+	if r.err != nil || len(r.buf) == 0 {
+		r.err = ErrBadFrame
+		return 0
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b
+}
+
+func (r *frameReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = ErrBadFrame
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *frameReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = ErrBadFrame
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *frameReader) bytes(n uint64) []byte {
+	if r.err != nil || n > uint64(len(r.buf)) {
+		r.err = ErrBadFrame
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *frameReader) points() []config.Point {
+	n := r.uvarint()
+	// every point takes at least 3 bytes
+	if r.err != nil || n > uint64(len(r.buf))/3 {
+		r.err = ErrBadFrame
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+
+	points := make([]config.Point, n)
+	var x, y, p int64
+	for i := range points {
+		x += r.varint()
+		y += r.varint()
+		p += r.varint()
+		points[i] = config.Point{
+			X: float64(x) / PointScale,
+			Y: float64(y) / PointScale,
+			P: float64(p) / PressureScale,
+		}
+	}
+
+	return points
+}
@@ -19,3 +19,26 @@ func ColorFromUserID(userID string) string {
 	hue := int(hash % 360)
 	return fmt.Sprintf("hsl(%d, 70%%, 55%%)", hue)
 }
+
+var (
+	guestAdjectives = []string{
+		"Amber", "Brave", "Calm", "Clever", "Eager", "Gentle", "Happy", "Jolly",
+		"Lucky", "Mellow", "Nimble", "Quiet", "Rapid", "Sunny", "Swift", "Witty",
+	}
+	guestAnimals = []string{
+		"Badger", "Crane", "Dolphin", "Falcon", "Fox", "Heron", "Koala", "Lynx",
+		"Otter", "Owl", "Panda", "Puffin", "Raven", "Seal", "Tiger", "Wolf",
+	}
+)
+
+// GuestName is the display name of an anonymous viewer, stable for the
+// same id like ColorFromUserID
+func GuestName(userID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userID))
+	hash := h.Sum32()
+
+	adj := guestAdjectives[hash%uint32(len(guestAdjectives))]
+	animal := guestAnimals[(hash/uint32(len(guestAdjectives)))%uint32(len(guestAnimals))]
+	return adj + " " + animal
+}
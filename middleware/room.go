@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+// ErrRoomMismatch is a request naming more than one room
+var ErrRoomMismatch = errors.New("roomId does not match")
+
+// MaxRoomBodyBytes caps the body RoomFromRequest reads, room requests are
+// small JSON
+const MaxRoomBodyBytes = 1 << 20
+
+// RoomFromRequest finds the room a request is about: the roomId query
+// param, the room of an object key (rooms/<room>/...) and a roomId field in
+// a JSON body. Every one that is set must name the same room, else the
+// check would pass on one room while the handler acts on another. The body
+// is left readable for the handler, a body over MaxRoomBodyBytes is an
+// *http.MaxBytesError.
+func RoomFromRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	q := r.URL.Query()
+	found := []string{q.Get("roomId")}
+
+	if key := q.Get("key"); strings.HasPrefix(key, "rooms/") {
+		roomID, _, _ := strings.Cut(strings.TrimPrefix(key, "rooms/"), "/")
+		found = append(found, roomID)
+	}
+
+	if r.Body != nil && r.Method != http.MethodGet {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxRoomBodyBytes))
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+
+		var req struct {
+			RoomID string `json:"roomId"`
+		}
+		if json.Unmarshal(body, &req) == nil {
+			found = append(found, req.RoomID)
+		}
+	}
+
+	roomID := ""
+	for _, id := range found {
+		if id == "" {
+			continue
+		}
+		if roomID != "" && id != roomID {
+			return "", ErrRoomMismatch
+		}
+		roomID = id
+	}
+	return roomID, nil
+}
+
+// RequireRoomRole lets the request through when the session user has at
+// least reqRole in the room of the request (see db.RoomAccess.Role, global
+// admins count as owners). Must run after RequireSession or AuthMiddleware,
+// the room and role are put on the context for the handler, which must act
+// on that room only.
+func RequireRoomRole(next http.Handler, reqRole config.Role) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := r.Context().Value(config.ContextUserIDKey).(string)
+		if userID == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		roomID, err := RoomFromRequest(w, r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "roomId does not match", http.StatusBadRequest)
+			return
+		}
+		if roomID == "" {
+			http.Error(w, "roomId required", http.StatusBadRequest)
+			return
+		}
+
+		access, err := db.GetRoomAccess(roomID, userID)
+		if err != nil {
+			fmt.Printf("Error checking room access: %v\n", err)
+			http.Error(w, "cannot get room role", 500)
+			return
+		}
+		if !access.Exists {
+			http.Error(w, "room not exist", http.StatusNotFound)
+			return
+		}
+
+		// views need CanView, anything from RoleMember up CanEdit too
+		role, _ := access.Role()
+		switch {
+		case !access.CanView(),
+			reqRole >= config.RoleMember && !access.CanEdit(),
+			role < reqRole:
+			http.Error(w, "no perm", 403)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), config.ContextRoomIDKey, roomID)
+		ctx = context.WithValue(ctx, config.ContextRoomRoleKey, role)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,252 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// A4 landscape in points
+const (
+	pageW  = 842.0
+	pageH  = 595.0
+	margin = 36.0
+)
+
+// Page is one pdf page, the server makes one per visible layer
+type Page struct {
+	Title string
+	Scene Scene
+}
+
+// PDF writes a vector pdf with one A4 landscape page per entry, every
+// scene scaled to fit its page. Erase strokes are painted white since pdf
+// has no cheap way to cut earlier paths, so they also cover the doms under
+// them. Doms are linked placeholders like in the svg, http(s) links only.
+func PDF(out io.Writer, pages []Page, opts Options) error {
+	if len(pages) == 0 {
+		pages = []Page{{}}
+	}
+
+	p := &pdfWriter{}
+	p.buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	catalog := p.alloc()
+	tree := p.alloc()
+	font := p.alloc()
+
+	kids := make([]string, 0, len(pages))
+	for _, page := range pages {
+		id, err := p.page(page, tree, font, opts)
+		if err != nil {
+			return err
+		}
+		kids = append(kids, fmt.Sprintf("%d 0 R", id))
+	}
+
+	p.obj(font, "<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	p.obj(tree, fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids)))
+	p.obj(catalog, fmt.Sprintf("<< /Type /Catalog /Pages %d 0 R >>", tree))
+
+	xref := p.buf.Len()
+	fmt.Fprintf(&p.buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		fmt.Fprintf(&p.buf, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&p.buf, "trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, catalog, xref)
+
+	_, err := out.Write(p.buf.Bytes())
+	return err
+}
+
+type pdfWriter struct {
+	buf     bytes.Buffer
+	offsets []int // by object id - 1
+}
+
+func (p *pdfWriter) alloc() int {
+	p.offsets = append(p.offsets, 0)
+	return len(p.offsets)
+}
+
+func (p *pdfWriter) obj(id int, body string) {
+	p.offsets[id-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\nendobj\n", id, body)
+}
+
+func (p *pdfWriter) stream(id int, data []byte) error {
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	p.offsets[id-1] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", id, z.Len())
+	p.buf.Write(z.Bytes())
+	p.buf.WriteString("\nendstream\nendobj\n")
+	return nil
+}
+
+func (p *pdfWriter) page(page Page, tree, font int, opts Options) (int, error) {
+	s := page.Scene
+	b := s.Bounds()
+
+	// board units -> points, y flipped so the board is drawn top down
+	scale := math.Min((pageW-2*margin)/b.W, (pageH-2*margin)/b.H)
+	tx := margin + ((pageW-2*margin)-b.W*scale)/2 - b.X*scale
+	ty := pageH - margin - ((pageH-2*margin)-b.H*scale)/2 + b.Y*scale
+	toPage := func(x, y float64) (float64, float64) {
+		return tx + x*scale, ty - y*scale
+	}
+
+	var c strings.Builder
+	states := map[float64]string{}
+	var annots []string
+
+	fmt.Fprintf(&c, "q %s 0 0 %s %s %s cm\n", num(scale), num(-scale), num(tx), num(ty))
+	c.WriteString("1 J 1 j\n")
+
+	for _, d := range s.Doms {
+		t := d.Transform
+		if t.W <= 0 || t.H <= 0 {
+			continue
+		}
+
+		sin, cos := math.Sincos(t.Rot * math.Pi / 180)
+		fmt.Fprintf(&c, "q %s %s %s %s %s %s cm\n",
+			num(cos), num(sin), num(-sin), num(cos), num(t.X+t.W/2), num(t.Y+t.H/2))
+		fmt.Fprintf(&c, "0.95 0.95 0.95 rg 0.6 0.6 0.6 RG 1 w %s %s %s %s re B\n",
+			num(-t.W/2), num(-t.H/2), num(t.W), num(t.H))
+		// undo the flip for the label, Helvetica is about half an em wide
+		fmt.Fprintf(&c, "BT /F1 14 Tf 0.33 0.33 0.33 rg 1 0 0 -1 %s 5 Tm (%s) Tj ET\nQ\n",
+			num(-float64(len(d.Kind))*14*0.28), pdfString(d.Kind))
+
+		url := opts.link(d)
+		if url != "" {
+			minX, minY := math.Inf(1), math.Inf(1)
+			maxX, maxY := math.Inf(-1), math.Inf(-1)
+			for _, corner := range Corners(t) {
+				x, y := toPage(corner[0], corner[1])
+				minX, minY = math.Min(minX, x), math.Min(minY, y)
+				maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+			}
+			annots = append(annots, fmt.Sprintf(
+				"<< /Type /Annot /Subtype /Link /Rect [%s %s %s %s] /Border [0 0 0] /A << /S /URI /URI (%s) >> >>",
+				num(minX), num(minY), num(maxX), num(maxY), pdfString(url),
+			))
+		}
+	}
+
+	for _, st := range s.Strokes {
+		if len(st.Points) == 0 {
+			continue
+		}
+
+		col := parseColor(st.Color)
+		opacity := st.Opacity
+		if opacity <= 0 || opacity > 1 {
+			opacity = 1
+		}
+		opacity *= float64(col.A) / 255
+		if st.Operation == "erase" {
+			col.R, col.G, col.B = 255, 255, 255
+			opacity = 1
+		}
+
+		c.WriteString("q ")
+		if opacity < 1 {
+			name, ok := states[opacity]
+			if !ok {
+				name = fmt.Sprintf("GS%d", len(states)+1)
+				states[opacity] = name
+			}
+			fmt.Fprintf(&c, "/%s gs ", name)
+		}
+		fmt.Fprintf(&c, "%s %s %s RG\n",
+			num(float64(col.R)/255), num(float64(col.G)/255), num(float64(col.B)/255))
+		writePDFStroke(&c, st)
+		c.WriteString("Q\n")
+	}
+	c.WriteString("Q\n")
+
+	if page.Title != "" {
+		fmt.Fprintf(&c, "BT /F1 10 Tf 0.4 0.4 0.4 rg %s %s Td (%s) Tj ET\n",
+			num(margin), num(pageH-margin/2-4), pdfString(page.Title))
+	}
+
+	content := p.alloc()
+	if err := p.stream(content, []byte(c.String())); err != nil {
+		return 0, err
+	}
+
+	var gs strings.Builder
+	for opacity, name := range states {
+		fmt.Fprintf(&gs, "/%s << /Type /ExtGState /CA %s /ca %s >> ", name, num(opacity), num(opacity))
+	}
+
+	id := p.alloc()
+	p.obj(id, fmt.Sprintf(
+		"<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %s %s] /Contents %d 0 R /Resources << /Font << /F1 %d 0 R >> /ExtGState << %s>> >> /Annots [%s] >>",
+		tree, num(pageW), num(pageH), content, font, gs.String(), strings.Join(annots, " "),
+	))
+	return id, nil
+}
+
+// same split as the svg: one path at constant width, else per segment
+func writePDFStroke(c *strings.Builder, st config.StrokeObjectInterface) {
+	pts := st.Points
+
+	uniform := true
+	for _, p := range pts[1:] {
+		if Width(st, p) != Width(st, pts[0]) {
+			uniform = false
+			break
+		}
+	}
+
+	if uniform {
+		fmt.Fprintf(c, "%s w %s %s m", num(Width(st, pts[0])), num(pts[0].X), num(pts[0].Y))
+		if len(pts) == 1 {
+			// a dot, round caps draw it
+			fmt.Fprintf(c, " %s %s l", num(pts[0].X), num(pts[0].Y))
+		}
+		for _, p := range pts[1:] {
+			fmt.Fprintf(c, " %s %s l", num(p.X), num(p.Y))
+		}
+		c.WriteString(" S\n")
+		return
+	}
+
+	for i := 1; i < len(pts); i++ {
+		a, b := pts[i-1], pts[i]
+		fmt.Fprintf(c, "%s w %s %s m %s %s l S\n",
+			num((Width(st, a)+Width(st, b))/2), num(a.X), num(a.Y), num(b.X), num(b.Y))
+	}
+}
+
+// pdfString escapes a literal string, Helvetica only has WinAnsi glyphs so
+// anything outside ascii becomes ?
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 32 || r > 126:
+			b.WriteByte('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
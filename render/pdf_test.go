@@ -0,0 +1,66 @@
+package render
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+func TestPDFDomLinks(t *testing.T) {
+	dom := func(id, payload string) config.DomObjectNetwork {
+		return config.DomObjectNetwork{
+			ID:        id,
+			Kind:      "video",
+			Payload:   payload,
+			Transform: config.Transform{W: 10, H: 10},
+		}
+	}
+
+	scene := Scene{Doms: []config.DomObjectNetwork{
+		dom("a", "javascript:alert(1)"),
+		dom("b", "https://example.com/v.mp4"),
+		dom("c", "rooms/victim/v.mp4"),
+	}}
+
+	var out bytes.Buffer
+	if err := PDF(&out, []Page{{Scene: scene}}, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// annotations sit in the page dict, uncompressed
+	uris := regexp.MustCompile(`/URI \(([^)]*)\)`).FindAllStringSubmatch(out.String(), -1)
+	if len(uris) != 1 || uris[0][1] != "https://example.com/v.mp4" {
+		t.Fatalf("links %v, want only the https one", uris)
+	}
+
+	// and the placeholders are still drawn for all three
+	if n := strings.Count(pageContent(t, out.Bytes()), " re B"); n != 3 {
+		t.Fatalf("%d placeholders, want 3", n)
+	}
+}
+
+// pageContent inflates the first stream of a pdf
+func pageContent(t *testing.T, pdf []byte) string {
+	t.Helper()
+
+	start := bytes.Index(pdf, []byte("stream\n"))
+	end := bytes.Index(pdf, []byte("\nendstream"))
+	if start < 0 || end < 0 {
+		t.Fatal("no stream in pdf")
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(pdf[start+len("stream\n") : end]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,198 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PNG rasterises the strokes of the scene into a w x h png on white, the
+// scene is scaled to fit and centered. Doms are not drawn, their content
+// lives in R2.
+func PNG(out io.Writer, s Scene, w, h int) error {
+	return png.Encode(out, Raster(s, w, h))
+}
+
+func Raster(s Scene, w, h int) *image.RGBA {
+	b := s.Bounds()
+	scale := math.Min(float64(w)/b.W, float64(h)/b.H)
+	offX := (float64(w) - b.W*scale) / 2
+	offY := (float64(h) - b.H*scale) / 2
+
+	// strokes go on their own layer so erasing does not cut the background
+	ink := image.NewRGBA(image.Rect(0, 0, w, h))
+	for _, st := range s.Strokes {
+		if len(st.Points) == 0 {
+			continue
+		}
+
+		pts := make([]point, len(st.Points))
+		for i, p := range st.Points {
+			pts[i] = point{
+				x: (p.X-b.X)*scale + offX,
+				y: (p.Y-b.Y)*scale + offY,
+				// thin lines would vanish in a thumbnail
+				r: math.Max(Width(st, p)*scale/2, 0.5),
+			}
+		}
+
+		cov, area := coverage(pts, ink.Bounds())
+		if st.Operation == "erase" {
+			erase(ink, cov, area)
+			continue
+		}
+
+		opacity := st.Opacity
+		if opacity <= 0 || opacity > 1 {
+			opacity = 1
+		}
+		paint(ink, cov, area, parseColor(st.Color), opacity)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds(), ink, image.Point{}, draw.Over)
+	return img
+}
+
+type point struct{ x, y, r float64 }
+
+// coverage of one stroke per pixel inside area, the max over its segments
+// so a translucent stroke does not darken where it overlaps itself
+func coverage(pts []point, bounds image.Rectangle) ([]float64, image.Rectangle) {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range pts {
+		minX = math.Min(minX, p.x-p.r)
+		minY = math.Min(minY, p.y-p.r)
+		maxX = math.Max(maxX, p.x+p.r)
+		maxY = math.Max(maxY, p.y+p.r)
+	}
+
+	area := image.Rect(
+		int(math.Floor(minX))-1, int(math.Floor(minY))-1,
+		int(math.Ceil(maxX))+1, int(math.Ceil(maxY))+1,
+	).Intersect(bounds)
+	cov := make([]float64, area.Dx()*area.Dy())
+	if area.Empty() {
+		return cov, area
+	}
+
+	segment := func(a, c point) {
+		x0 := max(int(math.Floor(math.Min(a.x-a.r, c.x-c.r)))-1, area.Min.X)
+		y0 := max(int(math.Floor(math.Min(a.y-a.r, c.y-c.r)))-1, area.Min.Y)
+		x1 := min(int(math.Ceil(math.Max(a.x+a.r, c.x+c.r)))+1, area.Max.X)
+		y1 := min(int(math.Ceil(math.Max(a.y+a.r, c.y+c.r)))+1, area.Max.Y)
+
+		dx, dy := c.x-a.x, c.y-a.y
+		length2 := dx*dx + dy*dy
+
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				px, py := float64(x)+0.5, float64(y)+0.5
+
+				t := 0.0
+				if length2 > 0 {
+					t = math.Max(0, math.Min(1, ((px-a.x)*dx+(py-a.y)*dy)/length2))
+				}
+				d := math.Hypot(px-(a.x+t*dx), py-(a.y+t*dy))
+				r := a.r + t*(c.r-a.r)
+
+				// one pixel of falloff for anti-aliasing
+				v := math.Max(0, math.Min(1, r-d+0.5))
+				i := (y-area.Min.Y)*area.Dx() + (x - area.Min.X)
+				if v > cov[i] {
+					cov[i] = v
+				}
+			}
+		}
+	}
+
+	if len(pts) == 1 {
+		segment(pts[0], pts[0])
+	}
+	for i := 1; i < len(pts); i++ {
+		segment(pts[i-1], pts[i])
+	}
+	return cov, area
+}
+
+func paint(img *image.RGBA, cov []float64, area image.Rectangle, c color.RGBA, opacity float64) {
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			a := cov[(y-area.Min.Y)*area.Dx()+(x-area.Min.X)] * opacity * float64(c.A) / 255
+			if a <= 0 {
+				continue
+			}
+
+			// source over, img is premultiplied
+			o := img.PixOffset(x, y)
+			px := img.Pix[o : o+4 : o+4]
+			px[0] = uint8(float64(c.R)*a + float64(px[0])*(1-a))
+			px[1] = uint8(float64(c.G)*a + float64(px[1])*(1-a))
+			px[2] = uint8(float64(c.B)*a + float64(px[2])*(1-a))
+			px[3] = uint8(255*a + float64(px[3])*(1-a))
+		}
+	}
+}
+
+func erase(img *image.RGBA, cov []float64, area image.Rectangle) {
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			keep := 1 - cov[(y-area.Min.Y)*area.Dx()+(x-area.Min.X)]
+			if keep >= 1 {
+				continue
+			}
+
+			o := img.PixOffset(x, y)
+			px := img.Pix[o : o+4 : o+4]
+			for i := range px {
+				px[i] = uint8(float64(px[i]) * keep)
+			}
+		}
+	}
+}
+
+var namedColors = map[string]color.RGBA{
+	"black":  {0, 0, 0, 255},
+	"white":  {255, 255, 255, 255},
+	"red":    {255, 0, 0, 255},
+	"green":  {0, 128, 0, 255},
+	"blue":   {0, 0, 255, 255},
+	"yellow": {255, 255, 0, 255},
+	"orange": {255, 165, 0, 255},
+	"purple": {128, 0, 128, 255},
+	"gray":   {128, 128, 128, 255},
+	"grey":   {128, 128, 128, 255},
+}
+
+// parseColor reads #rgb, #rrggbb, #rrggbbaa and a few names, anything else
+// is drawn black
+func parseColor(s string) color.RGBA {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if c, ok := namedColors[s]; ok {
+		return c
+	}
+
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	if len(hex) != 8 {
+		return color.RGBA{A: 255}
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.RGBA{A: 255}
+	}
+	return color.RGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+}
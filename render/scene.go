@@ -0,0 +1,98 @@
+package render
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+// Padding around the drawn content, in board units
+const Padding = 16
+
+// Scene is one layer as it is drawn: strokes in clock order, doms in
+// creation order.
+type Scene struct {
+	Strokes []config.StrokeObjectInterface
+	Doms    []config.DomObjectNetwork
+}
+
+// NewScene decodes stroke-add events (see db.GetLayerStateAt), events that
+// do not decode are skipped like the replay does.
+func NewScene(strokes []config.Event, doms []config.DomObjectNetwork) Scene {
+	s := Scene{Doms: doms}
+	for _, e := range strokes {
+		var stroke config.StrokeObjectInterface
+		if err := json.Unmarshal(e.Payload, &stroke); err != nil {
+			continue
+		}
+		s.Strokes = append(s.Strokes, stroke)
+	}
+	return s
+}
+
+type Rect struct {
+	X, Y, W, H float64
+}
+
+// Bounds is the box around everything in the scene plus Padding, a 1x1 box
+// for an empty scene.
+func (s Scene) Bounds() Rect {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	grow := func(x, y, r float64) {
+		minX = math.Min(minX, x-r)
+		minY = math.Min(minY, y-r)
+		maxX = math.Max(maxX, x+r)
+		maxY = math.Max(maxY, y+r)
+	}
+
+	for _, st := range s.Strokes {
+		for _, p := range st.Points {
+			grow(p.X, p.Y, Width(st, p)/2)
+		}
+	}
+	for _, d := range s.Doms {
+		for _, c := range Corners(d.Transform) {
+			grow(c[0], c[1], 0)
+		}
+	}
+
+	if math.IsInf(minX, 1) {
+		return Rect{W: 1, H: 1}
+	}
+	return Rect{
+		X: minX - Padding,
+		Y: minY - Padding,
+		W: maxX - minX + 2*Padding,
+		H: maxY - minY + 2*Padding,
+	}
+}
+
+// Width of a stroke at a point, pressure scales the size and 0 means the
+// client sent none.
+func Width(st config.StrokeObjectInterface, p config.Point) float64 {
+	size := float64(st.Size)
+	if size <= 0 {
+		size = 1
+	}
+	if p.P <= 0 {
+		return size
+	}
+	return size * p.P
+}
+
+// Corners of a dom after rotation (degrees, around its center)
+func Corners(t config.Transform) [4][2]float64 {
+	cx, cy := t.X+t.W/2, t.Y+t.H/2
+	sin, cos := math.Sincos(t.Rot * math.Pi / 180)
+
+	var out [4][2]float64
+	for i, c := range [4][2]float64{
+		{t.X, t.Y}, {t.X + t.W, t.Y}, {t.X + t.W, t.Y + t.H}, {t.X, t.Y + t.H},
+	} {
+		dx, dy := c[0]-cx, c[1]-cy
+		out[i] = [2]float64{cx + dx*cos - dy*sin, cy + dx*sin + dy*cos}
+	}
+	return out
+}
@@ -0,0 +1,190 @@
+package render
+
+import (
+	"fmt"
+	"html"
+	"io"
+	neturl "net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+type Options struct {
+	// ObjectURL resolves the link of a dom, by default its payload
+	ObjectURL func(d config.DomObjectNetwork) string
+	// Background fill, empty keeps it transparent
+	Background string
+}
+
+// link is the url a dom points at, empty unless it is http or https so a
+// payload can never become a javascript: or data: link
+func (o Options) link(d config.DomObjectNetwork) string {
+	url := d.Payload
+	if o.ObjectURL != nil {
+		url = o.ObjectURL(d)
+	}
+	return SafeURL(url)
+}
+
+// SafeURL is s when it is an absolute http or https url, empty otherwise
+func SafeURL(s string) string {
+	u, err := neturl.Parse(s)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "http" && scheme != "https" {
+		return ""
+	}
+	return s
+}
+
+// SVG writes the scene as a standalone svg. Doms sit under the strokes and
+// erase strokes mask everything drawn before them, like the canvas does.
+func SVG(w io.Writer, s Scene, opts Options) error {
+	b := s.Bounds()
+	box := fmt.Sprintf("%s %s %s %s", num(b.X), num(b.Y), num(b.W), num(b.H))
+
+	var defs, body strings.Builder
+	erased := 0
+	for _, st := range s.Strokes {
+		if len(st.Points) == 0 {
+			continue
+		}
+
+		if st.Operation == "erase" {
+			erased++
+			id := "erase" + strconv.Itoa(erased)
+			fmt.Fprintf(&defs,
+				`<mask id="%s" maskUnits="userSpaceOnUse" x="%s" y="%s" width="%s" height="%s"><rect x="%s" y="%s" width="%s" height="%s" fill="white"/>`,
+				id, num(b.X), num(b.Y), num(b.W), num(b.H), num(b.X), num(b.Y), num(b.W), num(b.H),
+			)
+			writeStroke(&defs, st, "black", 1)
+			defs.WriteString(`</mask>`)
+
+			inner := body.String()
+			body.Reset()
+			fmt.Fprintf(&body, `<g mask="url(#%s)">%s</g>`, id, inner)
+			continue
+		}
+
+		opacity := st.Opacity
+		if opacity <= 0 || opacity > 1 {
+			opacity = 1
+		}
+		writeStroke(&body, st, st.Color, opacity)
+	}
+
+	var doms strings.Builder
+	for _, d := range s.Doms {
+		writeDom(&doms, d, opts)
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out,
+		`<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="%s" width="%s" height="%s">`,
+		box, num(b.W), num(b.H),
+	)
+	if defs.Len() > 0 {
+		fmt.Fprintf(&out, `<defs>%s</defs>`, defs.String())
+	}
+	if opts.Background != "" {
+		fmt.Fprintf(&out, `<rect x="%s" y="%s" width="%s" height="%s" fill="%s"/>`,
+			num(b.X), num(b.Y), num(b.W), num(b.H), attr(opts.Background))
+	}
+	out.WriteString(doms.String())
+	fmt.Fprintf(&out, `<g fill="none" stroke-linecap="round" stroke-linejoin="round">%s</g>`, body.String())
+	out.WriteString(`</svg>`)
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// one path when the width is constant, otherwise a segment per point pair
+// grouped so overlapping segments do not stack their opacity
+func writeStroke(b *strings.Builder, st config.StrokeObjectInterface, color string, opacity float64) {
+	pts := st.Points
+	color = attr(color)
+
+	uniform := true
+	for _, p := range pts[1:] {
+		if Width(st, p) != Width(st, pts[0]) {
+			uniform = false
+			break
+		}
+	}
+
+	if uniform {
+		b.WriteString(`<path d="M`)
+		b.WriteString(num(pts[0].X) + " " + num(pts[0].Y))
+		if len(pts) == 1 {
+			// a dot, round caps draw it
+			b.WriteString(" L" + num(pts[0].X) + " " + num(pts[0].Y))
+		}
+		for _, p := range pts[1:] {
+			b.WriteString(" L" + num(p.X) + " " + num(p.Y))
+		}
+		fmt.Fprintf(b, `" stroke="%s" stroke-width="%s"`, color, num(Width(st, pts[0])))
+		if opacity < 1 {
+			fmt.Fprintf(b, ` stroke-opacity="%s"`, num(opacity))
+		}
+		b.WriteString(`/>`)
+		return
+	}
+
+	if opacity < 1 {
+		fmt.Fprintf(b, `<g opacity="%s">`, num(opacity))
+	} else {
+		b.WriteString(`<g>`)
+	}
+	for i := 1; i < len(pts); i++ {
+		a, c := pts[i-1], pts[i]
+		fmt.Fprintf(b, `<line x1="%s" y1="%s" x2="%s" y2="%s" stroke="%s" stroke-width="%s"/>`,
+			num(a.X), num(a.Y), num(c.X), num(c.Y), color, num((Width(st, a)+Width(st, c))/2))
+	}
+	b.WriteString(`</g>`)
+}
+
+func writeDom(b *strings.Builder, d config.DomObjectNetwork, opts Options) {
+	t := d.Transform
+	if t.W <= 0 || t.H <= 0 {
+		return
+	}
+
+	url := attr(opts.link(d))
+
+	transform := ""
+	if t.Rot != 0 {
+		transform = fmt.Sprintf(` transform="rotate(%s %s %s)"`, num(t.Rot), num(t.X+t.W/2), num(t.Y+t.H/2))
+	}
+	rect := fmt.Sprintf(`x="%s" y="%s" width="%s" height="%s"`, num(t.X), num(t.Y), num(t.W), num(t.H))
+
+	if d.Kind == "img" {
+		fmt.Fprintf(b, `<image href="%s" xlink:href="%s" %s preserveAspectRatio="none"%s/>`, url, url, rect, transform)
+		return
+	}
+
+	// video, audio: a linked placeholder, a group when there is no link
+	if url != "" {
+		fmt.Fprintf(b, `<a href="%s" xlink:href="%s"%s>`, url, url, transform)
+	} else {
+		fmt.Fprintf(b, `<g%s>`, transform)
+	}
+	fmt.Fprintf(b, `<rect %s fill="#f3f3f3" stroke="#999"/>`, rect)
+	fmt.Fprintf(b, `<text x="%s" y="%s" text-anchor="middle" dominant-baseline="middle" font-family="sans-serif" font-size="14" fill="#555">%s</text>`,
+		num(t.X+t.W/2), num(t.Y+t.H/2), html.EscapeString(d.Kind))
+	if url != "" {
+		b.WriteString(`</a>`)
+	} else {
+		b.WriteString(`</g>`)
+	}
+}
+
+func num(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 32)
+}
+
+func attr(s string) string {
+	return html.EscapeString(s)
+}
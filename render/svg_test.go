@@ -0,0 +1,68 @@
+package render
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+)
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"https://cdn.example.com/a.png", "https://cdn.example.com/a.png"},
+		{"HTTP://cdn.example.com/a.png", "HTTP://cdn.example.com/a.png"},
+		{"javascript:alert(1)", ""},
+		{"JavaScript:alert(1)", ""},
+		{"data:image/svg+xml;base64,PHN2Zz4=", ""},
+		{"//cdn.example.com/a.png", ""},
+		{"rooms/r/a.png", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := SafeURL(tt.in); got != tt.want {
+			t.Errorf("SafeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSVGDomLinks(t *testing.T) {
+	dom := func(kind, payload string) config.DomObjectNetwork {
+		return config.DomObjectNetwork{
+			ID:        "d-" + kind,
+			Kind:      kind,
+			Payload:   payload,
+			Transform: config.Transform{X: 0, Y: 0, W: 10, H: 10},
+		}
+	}
+
+	tests := []struct {
+		name string
+		dom  config.DomObjectNetwork
+		want string
+	}{
+		{"image with javascript", dom("img", "javascript:alert(1)"), `href=""`},
+		{"video with javascript", dom("video", "javascript:alert(1)"), `<g>`},
+		{"image with https", dom("img", "https://cdn.example.com/a.png"), `href="https://cdn.example.com/a.png"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			if err := SVG(&b, Scene{Doms: []config.DomObjectNetwork{tt.dom}}, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			out := b.String()
+
+			if strings.Contains(strings.ToLower(out), "javascript:") {
+				t.Fatalf("javascript link in svg: %s", out)
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Fatalf("svg has no %s: %s", tt.want, out)
+			}
+		})
+	}
+}
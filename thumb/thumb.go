@@ -0,0 +1,136 @@
+package thumb
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/render"
+)
+
+var (
+	Width  = 320
+	Height = 200
+	// rooms kept in the cache, the least recently used go first
+	MaxRooms = 1024
+)
+
+// thumbnails show the base layer only, it is the one every member sees
+const layer = 0
+
+type entry struct {
+	clock int64
+	png   []byte
+	used  time.Time
+}
+
+// cache holds one png per room keyed by the room clock it was drawn at, at
+// most MaxRooms of them. dirty are rooms with activity since the last Start
+// tick.
+var cache = struct {
+	mu    sync.Mutex
+	rooms map[string]entry
+	dirty map[string]bool
+}{
+	rooms: make(map[string]entry),
+	dirty: make(map[string]bool),
+}
+
+// Touch marks a room for regeneration on the next tick
+func Touch(roomID string) {
+	cache.mu.Lock()
+	cache.dirty[roomID] = true
+	cache.mu.Unlock()
+}
+
+// Start redraws touched rooms every interval, so a busy room is drawn at
+// most once per interval and Get usually hits the cache.
+func Start(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for range ticker.C {
+			cache.mu.Lock()
+			dirty := cache.dirty
+			cache.dirty = make(map[string]bool)
+			cache.mu.Unlock()
+
+			for roomID := range dirty {
+				if _, _, err := Get(roomID); err != nil {
+					fmt.Println("[thumb] redraw failed", roomID, err)
+				}
+			}
+		}
+	}()
+}
+
+// Get returns the room thumbnail and the clock it shows, drawing it first
+// when the cached one is behind the room.
+func Get(roomID string) ([]byte, int64, error) {
+	clock, err := db.GetMaxIdByRoom(roomID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cache.mu.Lock()
+	e, ok := cache.rooms[roomID]
+	if ok && e.clock == clock {
+		e.used = time.Now()
+		cache.rooms[roomID] = e
+		cache.mu.Unlock()
+		return e.png, e.clock, nil
+	}
+	cache.mu.Unlock()
+
+	strokes, doms, err := db.GetLayerStateAt(roomID, layer, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var buf bytes.Buffer
+	if err := render.PNG(&buf, render.NewScene(strokes, doms), Width, Height); err != nil {
+		return nil, 0, err
+	}
+
+	cache.mu.Lock()
+	// a concurrent Get may have drawn a newer one
+	if cur, ok := cache.rooms[roomID]; !ok || cur.clock <= clock {
+		cache.rooms[roomID] = entry{clock: clock, png: buf.Bytes(), used: time.Now()}
+		evict()
+	}
+	cache.mu.Unlock()
+
+	return buf.Bytes(), clock, nil
+}
+
+// Version is the clock of the cached thumbnail, 0 when there is none yet.
+// It goes into thumbnail urls so browsers refetch after a redraw.
+func Version(roomID string) int64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.rooms[roomID].clock
+}
+
+// Forget drops the thumbnail of a room that was deleted
+func Forget(roomID string) {
+	cache.mu.Lock()
+	delete(cache.rooms, roomID)
+	delete(cache.dirty, roomID)
+	cache.mu.Unlock()
+}
+
+// evict drops the least recently used rooms past MaxRooms, cache.mu is held
+func evict() {
+	for len(cache.rooms) > MaxRooms {
+		var oldest string
+		var at time.Time
+		for id, e := range cache.rooms {
+			if oldest == "" || e.used.Before(at) {
+				oldest, at = id, e.used
+			}
+		}
+		delete(cache.rooms, oldest)
+	}
+}
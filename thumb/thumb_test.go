@@ -0,0 +1,45 @@
+package thumb
+
+import (
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+func cached(roomID string) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	_, ok := cache.rooms[roomID]
+	return ok
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	db.OpenTestStore(t)
+
+	max := MaxRooms
+	MaxRooms = 2
+	t.Cleanup(func() { MaxRooms = max })
+
+	get := func(roomID string) {
+		t.Helper()
+		if _, _, err := Get(roomID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get("a")
+	get("b")
+	get("a") // a hit keeps a
+	get("c")
+
+	for room, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if got := cached(room); got != want {
+			t.Fatalf("room %s cached %v, want %v", room, got, want)
+		}
+	}
+
+	Forget("a")
+	if cached("a") {
+		t.Fatal("forgotten room still cached")
+	}
+}
@@ -0,0 +1,205 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/middleware"
+	"github.com/gorilla/websocket"
+)
+
+// CloseSlowConsumer is sent when a client could not keep up, the client
+// should reconnect and resync (see sendResume).
+const CloseSlowConsumer = 4008
+
+var (
+	// how long a client may stay behind before it is disconnected
+	SlowConsumerGrace = 5 * time.Second
+	// frames held for a client while its send channel is full
+	MaxOverflow = 1024
+)
+
+// queued is either a ready frame or a cursor / stroke update that can still
+// absorb newer updates for the same key until it is pumped.
+type queued struct {
+	frame *outFrame
+	msg   *config.ServerMsg
+	key   string
+}
+
+// outQueue holds what does not fit in Client.send, in order.
+type outQueue struct {
+	mu        sync.Mutex
+	overflow  []*queued
+	merge     map[string]*queued // key -> item queued after the last frame
+	slowSince time.Time
+	kicked    bool
+	// fires SlowConsumerGrace after slowSince, so a client is closed even
+	// when the room goes quiet and nothing else is enqueued
+	slowTimer *time.Timer
+}
+
+// enqueue hands f to the write loop without ever blocking the caller.
+// batch decodes f on demand, it is nil for direct replies.
+func (c *Client) enqueue(f outFrame, batch func() []config.ServerMsg) {
+	q := &c.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.kicked {
+		return
+	}
+
+	if len(q.overflow) == 0 {
+		select {
+		case c.send <- f:
+			return
+		default:
+		}
+		q.slowSince = time.Now()
+		q.slowTimer = time.AfterFunc(SlowConsumerGrace, c.checkSlow)
+	}
+
+	// behind: merge live-only traffic, keep everything else in order
+	var msgs []config.ServerMsg
+	if batch != nil {
+		msgs = batch()
+	}
+
+	if coalescable(msgs) {
+		for _, m := range msgs {
+			q.coalesce(m)
+		}
+	} else {
+		q.overflow = append(q.overflow, &queued{frame: &f})
+		q.merge = nil
+	}
+
+	if len(q.overflow) > MaxOverflow || time.Since(q.slowSince) > SlowConsumerGrace {
+		q.kicked = true
+		go c.kick()
+	}
+}
+
+// checkSlow runs from slowTimer, it kicks the client when it is still
+// behind once the grace is over
+func (c *Client) checkSlow() {
+	q := &c.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.kicked || q.slowSince.IsZero() {
+		return
+	}
+	if left := SlowConsumerGrace - time.Since(q.slowSince); left > 0 {
+		q.slowTimer = time.AfterFunc(left, c.checkSlow)
+		return
+	}
+
+	q.kicked = true
+	go c.kick()
+}
+
+func coalescable(msgs []config.ServerMsg) bool {
+	if len(msgs) == 0 {
+		return false
+	}
+	for _, m := range msgs {
+		switch m.Payload.Operation {
+		case "cursor-update", "stroke-update":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (q *outQueue) coalesce(m config.ServerMsg) {
+	key := m.Payload.Operation + ":" + m.Payload.ID
+
+	if it, ok := q.merge[key]; ok {
+		if m.Payload.Operation == "stroke-update" {
+			it.msg.Payload.Points = append(it.msg.Payload.Points, m.Payload.Points...)
+		} else {
+			// only the latest cursor matters
+			it.msg.Payload = m.Payload
+		}
+		return
+	}
+
+	// own copy, the decoded batch is shared by every slow client
+	m.Payload.Points = append([]config.Point(nil), m.Payload.Points...)
+	it := &queued{msg: &m, key: key}
+
+	if q.merge == nil {
+		q.merge = make(map[string]*queued)
+	}
+	q.merge[key] = it
+	q.overflow = append(q.overflow, it)
+}
+
+// pump moves held items into send as the write loop frees space.
+func (c *Client) pump() {
+	q := &c.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.overflow) > 0 {
+		it := q.overflow[0]
+
+		if it.frame == nil {
+			if q.merge[it.key] == it {
+				delete(q.merge, it.key)
+			}
+			f, err := c.frameFor(middleware.EncodeNetworkMsg([]config.ServerMsg{*it.msg}))
+			if err != nil {
+				q.overflow = q.overflow[1:]
+				continue
+			}
+			it.frame = &f
+		}
+
+		select {
+		case c.send <- *it.frame:
+			q.overflow = q.overflow[1:]
+		default:
+			return
+		}
+	}
+
+	q.overflow = nil
+	q.merge = nil
+	q.slowSince = time.Time{}
+	if q.slowTimer != nil {
+		q.slowTimer.Stop()
+		q.slowTimer = nil
+	}
+}
+
+// frameFor prepares an encoded []config.ServerMsg in the client's wire format
+func (c *Client) frameFor(data []byte) (outFrame, error) {
+	if c.binary {
+		bin, err := middleware.JSONToBinary(data)
+		if err != nil {
+			return outFrame{}, err
+		}
+		data = bin
+	}
+
+	return newFrame(data, c.binary)
+}
+
+// kick closes the socket with CloseSlowConsumer, the read loop then runs
+// the normal leave path.
+func (c *Client) kick() {
+	fmt.Println("slow consumer, closing", c.roomId, c.userId)
+
+	_ = c.conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(CloseSlowConsumer, "resync"),
+		time.Now().Add(time.Second),
+	)
+	_ = c.conn.Close()
+}
@@ -0,0 +1,53 @@
+package ws
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestSlowConsumerKickedWhenQuiet(t *testing.T) {
+	grace := SlowConsumerGrace
+	SlowConsumerGrace = 50 * time.Millisecond
+	t.Cleanup(func() { SlowConsumerGrace = grace })
+
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r, nil, 0, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	defer srv.Close()
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	// no write loop drains send, the client is behind from the second frame
+	c := &Client{conn: <-conns, send: make(chan outFrame, 1), done: make(chan struct{})}
+	for i := 0; i < 2; i++ {
+		f, err := newFrame([]byte(`[]`), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.enqueue(f, nil)
+	}
+
+	// then the room goes quiet, nothing else is enqueued
+	_ = peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = peer.ReadMessage()
+	var closed *websocket.CloseError
+	if !errors.As(err, &closed) || closed.Code != CloseSlowConsumer {
+		t.Fatalf("read %v, want close %d", err, CloseSlowConsumer)
+	}
+}
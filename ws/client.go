@@ -14,15 +14,23 @@ import (
 
 type Client struct {
 	conn    *websocket.Conn
-	send    chan []byte
+	send    chan outFrame
 	roomId  string
 	userId  string
 	profile string
 	color   string
 	name    string
-	role    config.Role
+	binary  bool // negotiated middleware.ProtocolBinary
+
+	// anonymous viewers have no account, they are not announced to the
+	// room and may only send config.ViewerOperations
+	anonymous bool
 
 	layer atomic.Int64
+	role  atomic.Int64 // config.Role, changes when the user joins or is promoted
+
+	out  outQueue
+	done chan struct{}
 
 	closeOnce sync.Once
 }
@@ -31,14 +39,19 @@ func (c *Client) read() {
 	defer c.close()
 
 	for {
-		_, raw, err := c.conn.ReadMessage()
+		msgType, raw, err := c.conn.ReadMessage()
 		if err != nil {
 			break
 		}
 
 		// fmt.Println("📥 RAW MESSAGE:", string(raw))
 
-		msgs, err := middleware.DecodeNetworkMsg(raw)
+		var msgs []config.NetworkMsg
+		if msgType == websocket.BinaryMessage {
+			msgs, err = middleware.DecodeBinaryMsg(raw)
+		} else {
+			msgs, err = middleware.DecodeNetworkMsg(raw)
+		}
 		if err != nil {
 			continue
 		}
@@ -74,13 +87,15 @@ func (c *Client) write() {
 
 	for {
 		select {
-		case msg, ok := <-c.send:
-			if !ok {
-				return
-			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		case msg := <-c.send:
+			if err := c.conn.WritePreparedMessage(msg.msg); err != nil {
 				return
 			}
+			Stats.Messages.Add(1)
+			Stats.PayloadBytes.Add(int64(msg.size))
+			c.pump()
+		case <-c.done:
+			return
 		case <-ticker.C:
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				fmt.Println("ping fail force close")
@@ -90,10 +105,21 @@ func (c *Client) write() {
 	}
 }
 
+// sendJSON queues an encoded []config.ServerMsg in the client's wire format
+func (c *Client) sendJSON(data []byte) {
+	f, err := c.frameFor(data)
+	if err != nil {
+		fmt.Println("prepare frame fail", err)
+		return
+	}
+	c.enqueue(f, nil)
+}
+
 func (c *Client) close() {
 	c.closeOnce.Do(func() {
 		H.Leave(c.roomId, c)
-		close(c.send)
+		// send stays open, a late enqueue must not panic
+		close(c.done)
 		_ = c.conn.Close()
 	})
 }
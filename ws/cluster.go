@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Tk21111/whiteboard_server/bus"
+	"github.com/google/uuid"
+)
+
+var (
+	roomBus bus.Bus = bus.NewLocal()
+	// tags what this instance published so it is not fanned out twice
+	instanceID = uuid.NewString()
+)
+
+// UseBus must be called before the server accepts sockets.
+func UseBus(b bus.Bus) {
+	roomBus = b
+}
+
+// envelope is what goes over the bus, Layer < 0 means every layer.
+type envelope struct {
+	Origin string          `json:"origin"`
+	Layer  int64           `json:"layer"`
+	Msg    json.RawMessage `json:"msg"`
+}
+
+func publish(roomID string, msg []byte, layer int64) {
+	data, err := json.Marshal(envelope{
+		Origin: instanceID,
+		Layer:  layer,
+		Msg:    msg,
+	})
+	if err != nil {
+		return
+	}
+
+	if err := roomBus.Publish(roomID, data); err != nil {
+		fmt.Println("[bus] publish err", roomID, err)
+	}
+}
+
+// subscribeRoom feeds broadcasts from other instances into the room goroutine.
+func subscribeRoom(room *Room) func() {
+	unsubscribe, err := roomBus.Subscribe(room.id, func(data []byte) {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			fmt.Println("[bus] bad envelope", room.id, err)
+			return
+		}
+		if env.Origin == instanceID {
+			return
+		}
+
+		// the bus reader serves every room, a room that is this far
+		// behind loses the message instead of stalling the others
+		if !room.tryAsync(func() {
+			room.fanOut(env.Msg, nil, env.Layer)
+		}) {
+			fmt.Println("[bus] room queue full, dropped", room.id)
+		}
+	})
+	if err != nil {
+		fmt.Println("[bus] subscribe err", room.id, err)
+		return nil
+	}
+
+	return unsubscribe
+}
+
+// sharedClock asks the bus for the next room clock when the bus can hand
+// them out, ok is false when the local room clock should be used.
+func sharedClock(roomID string, floor int64) (int64, bool) {
+	clocks, shared := roomBus.(bus.Clocks)
+	if !shared {
+		return 0, false
+	}
+
+	clock, err := clocks.NextClock(roomID, floor)
+	if err != nil {
+		// falls back to the local clock, which may collide with another instance
+		fmt.Println("[bus] next clock err", roomID, err)
+		return 0, false
+	}
+	return clock, true
+}
@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/bus"
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+// slowBus holds Subscribe of one room until release is closed, like a bus
+// whose server is slow to answer
+type slowBus struct {
+	*bus.Local
+	room    string
+	entered chan struct{}
+	release chan struct{}
+	subs    atomic.Int64 // live subscriptions
+}
+
+func (b *slowBus) Subscribe(roomID string, fn func([]byte)) (func(), error) {
+	if roomID == b.room {
+		close(b.entered)
+		<-b.release
+	}
+	unsubscribe, err := b.Local.Subscribe(roomID, fn)
+	if err != nil {
+		return nil, err
+	}
+	b.subs.Add(1)
+	return func() {
+		unsubscribe()
+		b.subs.Add(-1)
+	}, nil
+}
+
+func TestJoinSubscribesOutsideHubLock(t *testing.T) {
+	db.OpenTestStore(t)
+
+	b := &slowBus{
+		Local:   bus.NewLocal(),
+		room:    "slow-room",
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	old := roomBus
+	UseBus(b)
+	t.Cleanup(func() { UseBus(old) })
+
+	slow := newTestClient("slow-room", "a")
+	defer close(slow.stop)
+	joined := make(chan struct{})
+	go func() {
+		H.Join("slow-room", slow.Client)
+		close(joined)
+	}()
+	<-b.entered
+
+	// another room does not wait for the slow subscribe
+	other := newTestClient("other-room", "b")
+	defer close(other.stop)
+	done := make(chan struct{})
+	go func() {
+		H.Join("other-room", other.Client)
+		H.Leave("other-room", other.Client)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("join of another room waited for the bus")
+	}
+
+	// the room empties before its subscription is up, it must not be kept
+	H.Leave("slow-room", slow.Client)
+	close(b.release)
+	<-joined
+
+	if n := b.subs.Load(); n != 0 {
+		t.Fatalf("%d subscriptions left after every room closed", n)
+	}
+}
+
+func TestRoomTryAsyncFull(t *testing.T) {
+	room := newRoom("full-room", 0)
+	defer room.stop()
+
+	release := make(chan struct{})
+	room.async(func() { <-release })
+	for i := 0; i < roomQueueSize; i++ {
+		room.async(func() {})
+	}
+
+	// the bus reader must not stall on a room that is this far behind
+	ok := make(chan bool, 1)
+	go func() { ok <- room.tryAsync(func() {}) }()
+	select {
+	case queued := <-ok:
+		if queued {
+			t.Fatal("tryAsync queued on a full room")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("tryAsync blocked on a full room")
+	}
+	close(release)
+}
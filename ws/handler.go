@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync/atomic"
 
@@ -12,35 +13,58 @@ import (
 	"github.com/Tk21111/whiteboard_server/config"
 	"github.com/Tk21111/whiteboard_server/db"
 	"github.com/Tk21111/whiteboard_server/middleware"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin:       func(r *http.Request) bool { return true },
+	Subprotocols:      []string{middleware.ProtocolBinary, middleware.ProtocolJSON},
+	EnableCompression: true, // permessage-deflate when the client offers it
 }
 
 func HandleWS(w http.ResponseWriter, r *http.Request) {
 	roomId := r.URL.Query().Get("roomId")
 	token := r.URL.Query().Get("token")
 
-	if roomId == "" || token == "" {
+	if roomId == "" {
 		http.Error(w, "missing params", http.StatusUnauthorized)
 		return
 	}
 
-	user, err := auth.VerifyIDToken(token)
-	fmt.Println(user)
-	if err != nil {
-		http.Error(w, "invalid token", http.StatusUnauthorized)
-		return
-	}
+	var user *auth.GoogleUser
+	var role config.Role
 
-	role, err := db.EnsureUserInRoom(roomId, user.UserID)
-	if err != nil {
-		http.Error(w, "forbidden", http.StatusForbidden)
-		return
+	if token == "" {
+		// no account, only public rooms the owner opened to anonymous
+		// viewers (db.SetRoomAnonymous) let them watch
+		access, err := db.GetRoomAccess(roomId, "")
+		if err != nil || !access.Anonymous {
+			http.Error(w, "missing params", http.StatusUnauthorized)
+			return
+		}
+
+		id := "anon-" + uuid.NewString()
+		user = &auth.GoogleUser{UserID: id, Name: middleware.GuestName(id)}
+		role = config.RoleGuest
+	} else {
+		var err error
+		user, err = auth.VerifyIDToken(token)
+		if err != nil {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		// viewing does not join, see db.JoinRoomAs
+		access, err := db.GetRoomAccess(roomId, user.UserID)
+		if err != nil || !access.CanView() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		role, _ = access.Role()
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+
+	conn, err := upgrader.Upgrade(countingWriter{w}, r, nil)
 	if err != nil {
 		log.Println("upgrade:", err)
 		return
@@ -49,18 +73,21 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 	color := middleware.ColorFromUserID(user.UserID)
 
 	client := &Client{
-		conn:    conn,
-		send:    make(chan []byte, 256),
-		roomId:  roomId,
-		userId:  user.UserID,
-		name:    user.Name,
-		profile: user.Picture,
-		color:   color,
-		role:    role,
-		layer:   atomic.Int64{},
+		conn:      conn,
+		send:      make(chan outFrame, 256),
+		done:      make(chan struct{}),
+		roomId:    roomId,
+		userId:    user.UserID,
+		name:      user.Name,
+		profile:   user.Picture,
+		color:     color,
+		layer:     atomic.Int64{},
+		binary:    conn.Subprotocol() == middleware.ProtocolBinary,
+		anonymous: token == "",
 	}
 
 	client.layer.Store(0)
+	client.role.Store(int64(role))
 
 	/* --------------------------------------------------
 	   1. SEND EXISTING CLIENTS -> NEW CLIENT
@@ -72,6 +99,9 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 		msgs := make([]config.ServerMsg, 0, len(existingClients))
 
 		for _, c := range existingClients {
+			if c.anonymous {
+				continue
+			}
 			msgs = append(msgs, config.ServerMsg{
 				Payload: config.NetworkMsg{
 					Operation: "client-join",
@@ -89,17 +119,26 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 
 		data := middleware.EncodeNetworkMsg(msgs)
 		if data != nil {
-			client.send <- data
+			client.sendJSON(data)
 		}
 	}
 
-	replay, err := GetReplay(client.userId, client.roomId, client.layer.Load(), "0")
-	if err != nil {
-		return
-	}
-	data := middleware.EncodeNetworkMsg(replay)
-	if data != nil {
-		client.send <- data
+	// reconnecting clients pass the last clock they saw
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err := strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			since = 0
+		}
+		client.sendResume(since)
+	} else {
+		replay, err := GetReplay(client.userId, client.roomId, client.layer.Load(), "0", 0)
+		if err != nil {
+			return
+		}
+		data := middleware.EncodeNetworkMsg(replay)
+		if data != nil {
+			client.sendJSON(data)
+		}
 	}
 
 	/* --------------------------------------------------
@@ -127,7 +166,10 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	H.Broadcast(roomId, selfJoin, nil)
+	// anonymous viewers watch without showing up in the room
+	if !client.anonymous {
+		H.Broadcast(roomId, selfJoin, nil)
+	}
 
 	H.Join(roomId, client)
 	log.Println("join room", roomId, "user", client.userId)
@@ -136,19 +178,56 @@ func HandleWS(w http.ResponseWriter, r *http.Request) {
 	client.read()
 }
 
-func GetReplay(userID string, roomID string, layerIndex int64, from string) ([]config.ServerMsg, error) {
+// GetReplay returns the live board, or what changed since from when from is
+// not "0". A to clock > 0 replays history instead: the board as it was at to,
+// as a diff against from when the caller already shows that clock.
+func GetReplay(userID string, roomID string, layerIndex int64, from string, to int64) ([]config.ServerMsg, error) {
 	replay := make([]config.ServerMsg, 0) // Changed from 1 to 0
 
-	_, err := db.EnsureUserInRoom(roomID, userID)
+	ok, err := db.CanView(roomID, userID)
 	if err != nil {
 		return nil, err
 	}
+	if !ok {
+		return nil, db.ErrForbidden
+	}
 
 	if from == "" {
 		from = "0"
 	}
 
-	events, err := db.GetEvent(roomID, from, int(layerIndex))
+	if to > 0 {
+		since, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return historyReplay(roomID, layerIndex, since, to)
+	}
+
+	// a full replay goes through the latest snapshot instead of clock 0
+	var events []config.Event
+	if from == "0" {
+		events, _, err = db.GetStrokeState(roomID, layerIndex)
+	} else {
+		events, err = db.GetEvent(roomID, from, int(layerIndex))
+		if err != nil {
+			return nil, err
+		}
+
+		// the caller already has older state, tell it what went away
+		var since int64
+		since, err = strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		var removed []config.Event
+		removed, err = db.GetRemovedSince(roomID, since, layerIndex)
+		events = append(events, removed...)
+
+		// a stroke removed then redone must come back after its remove
+		sort.SliceStable(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -166,6 +245,9 @@ func GetReplay(userID string, roomID string, layerIndex int64, from string) ([]c
 				continue
 			}
 			payload.Stroke = &decoded
+
+		case "stroke-remove", "dom-remove":
+			payload.ID = e.EntityID
 		}
 
 		replay = append(replay, config.ServerMsg{
@@ -227,3 +309,41 @@ func GetReplay(userID string, roomID string, layerIndex int64, from string) ([]c
 
 	return replay, nil
 }
+
+// sendResume replays only what happened after since, or everything with
+// resync set when the log can not cover that gap (compacted, or the client is
+// ahead of the server after a restore).
+func (c *Client) sendResume(since int64) {
+	layer := c.layer.Load()
+	clock := currentClock(c.roomId)
+
+	resync := since <= 0 || since > clock
+	if !resync {
+		compacted, err := db.GetCompactedClock(c.roomId, layer)
+		if err != nil || since < compacted {
+			resync = true
+		}
+	}
+
+	from := "0"
+	if !resync {
+		from = strconv.FormatInt(since, 10)
+	}
+
+	replay, err := GetReplay(c.userId, c.roomId, layer, from, 0)
+	if err != nil {
+		fmt.Println("fail to get resume replay")
+		return
+	}
+
+	marker := config.ServerMsg{
+		Clock: clock,
+		Payload: config.NetworkMsg{
+			Operation: "resume",
+			Since:     &since,
+			Resync:    resync,
+		},
+	}
+
+	c.reply(append([]config.ServerMsg{marker}, replay...)...)
+}
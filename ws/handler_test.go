@@ -0,0 +1,64 @@
+package ws
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+func TestGetReplayResumeAfterRedo(t *testing.T) {
+	db.OpenTestStore(t)
+
+	if err := db.CreateRoomAs("resume-room", "owner", true); err != nil {
+		t.Fatal(err)
+	}
+
+	stroke, _ := json.Marshal(config.StrokeObjectInterface{ID: "a", Kind: "stroke"})
+	// the client holds clock 1, then "a" is undone and redone
+	for _, e := range []struct {
+		clock int64
+		op    string
+	}{
+		{1, "stroke-add"},
+		{2, "stroke-remove"},
+		{3, "stroke-add"},
+	} {
+		payload := json.RawMessage(`{}`)
+		if e.op == "stroke-add" {
+			payload = stroke
+		}
+		db.WriteEvent(config.Event{
+			EventMeta: config.EventMeta{ID: e.clock, RoomID: "resume-room", UserID: "owner"},
+			EntityID:  "a",
+			Op:        e.op,
+			Payload:   payload,
+			CreatedAt: e.clock,
+		})
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	replay, err := GetReplay("owner", "resume-room", 0, "1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []string
+	var last int64
+	for _, m := range replay {
+		if m.Clock == 0 {
+			continue
+		}
+		if m.Clock < last {
+			t.Fatalf("clock %d after %d, replay must keep clock order", m.Clock, last)
+		}
+		last = m.Clock
+		ops = append(ops, m.Payload.Operation)
+	}
+	if len(ops) != 2 || ops[0] != "stroke-remove" || ops[1] != "stroke-add" {
+		t.Fatalf("resume replay %v, want the remove then the redo", ops)
+	}
+}
@@ -0,0 +1,390 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+	"github.com/Tk21111/whiteboard_server/middleware"
+)
+
+const (
+	HistoryLimit = 100
+	HistoryTTL   = 1 * time.Hour
+)
+
+// one undoable step, enough to write both the inverse and the redo
+type historyEntry struct {
+	Op     string // stroke-add, dom-add, dom-transform, dom-remove
+	ID     string
+	Stroke *config.StrokeObjectInterface
+	Before *config.DomObjectNetwork
+	After  *config.DomObjectNetwork
+}
+
+type userHistory struct {
+	undo []historyEntry
+	redo []historyEntry
+	TTL  int64
+}
+
+type HistoryStruct struct {
+	buffer map[string]*userHistory // room:user:layer -> stacks
+	Mu     sync.Mutex
+}
+
+// last known dom state per room, used as the "before" of an undo entry
+// (the db writer is async so dom_objects can lag behind)
+type DomStateStruct struct {
+	buffer map[string]map[string]*config.DomObjectNetwork
+	Mu     sync.Mutex
+}
+
+var (
+	History = HistoryStruct{
+		buffer: make(map[string]*userHistory),
+	}
+	domStates = DomStateStruct{
+		buffer: make(map[string]map[string]*config.DomObjectNetwork),
+	}
+)
+
+func historyKey(roomId, userId string, layer int64) string {
+	return fmt.Sprintf("%s:%s:%d", roomId, userId, layer)
+}
+
+// Record pushes a new user action and drops the redo stack.
+func (h *HistoryStruct) Record(key string, e historyEntry) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	uh, ok := h.buffer[key]
+	if !ok {
+		uh = &userHistory{}
+		h.buffer[key] = uh
+	}
+	uh.TTL = time.Now().Add(HistoryTTL).UnixMilli()
+	uh.redo = nil
+
+	// a drag sends many transforms, keep it as one step
+	if n := len(uh.undo); n > 0 && e.Op == "dom-transform" {
+		top := &uh.undo[n-1]
+		if top.Op == "dom-transform" && top.ID == e.ID {
+			top.After = e.After
+			return
+		}
+	}
+
+	uh.undo = append(uh.undo, e)
+	if len(uh.undo) > HistoryLimit {
+		uh.undo = uh.undo[len(uh.undo)-HistoryLimit:]
+	}
+}
+
+func (h *HistoryStruct) pop(key string, undo bool) (historyEntry, bool) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	uh, ok := h.buffer[key]
+	if !ok {
+		return historyEntry{}, false
+	}
+
+	stack := &uh.redo
+	if undo {
+		stack = &uh.undo
+	}
+
+	n := len(*stack)
+	if n == 0 {
+		return historyEntry{}, false
+	}
+
+	e := (*stack)[n-1]
+	*stack = (*stack)[:n-1]
+	return e, true
+}
+
+func (h *HistoryStruct) push(key string, e historyEntry, undo bool) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	uh, ok := h.buffer[key]
+	if !ok {
+		uh = &userHistory{}
+		h.buffer[key] = uh
+	}
+	uh.TTL = time.Now().Add(HistoryTTL).UnixMilli()
+
+	if undo {
+		uh.undo = append(uh.undo, e)
+	} else {
+		uh.redo = append(uh.redo, e)
+	}
+}
+
+func (h *HistoryStruct) gc(now int64) {
+	h.Mu.Lock()
+	defer h.Mu.Unlock()
+
+	for key, uh := range h.buffer {
+		if uh.TTL > 0 && uh.TTL <= now {
+			delete(h.buffer, key)
+		}
+	}
+}
+
+func (d *DomStateStruct) Get(roomId, id string) (config.DomObjectNetwork, bool) {
+	d.Mu.Lock()
+	if room, ok := d.buffer[roomId]; ok {
+		if dom, ok := room[id]; ok {
+			d.Mu.Unlock()
+			return *dom, true
+		}
+	}
+	d.Mu.Unlock()
+
+	dom, ok, err := db.GetDomObject(roomId, id)
+	if err != nil {
+		fmt.Println("[db] get dom err", err)
+		return dom, false
+	}
+	if ok {
+		d.Set(roomId, dom)
+	}
+	return dom, ok
+}
+
+func (d *DomStateStruct) Set(roomId string, dom config.DomObjectNetwork) {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+
+	room, ok := d.buffer[roomId]
+	if !ok {
+		room = make(map[string]*config.DomObjectNetwork)
+		d.buffer[roomId] = room
+	}
+	room[dom.ID] = &dom
+}
+
+func (d *DomStateStruct) Delete(roomId, id string) {
+	d.Mu.Lock()
+	defer d.Mu.Unlock()
+
+	if room, ok := d.buffer[roomId]; ok {
+		delete(room, id)
+	}
+}
+
+func (d *DomStateStruct) Clear(roomId string) {
+	d.Mu.Lock()
+	delete(d.buffer, roomId)
+	d.Mu.Unlock()
+}
+
+/* --------------------------------------------------
+   PERSIST HELPERS (shared by handleMsg and undo/redo)
+   -------------------------------------------------- */
+
+func persistStrokeAdd(meta *config.EventMeta, s *config.StrokeObjectInterface) {
+	db.WriteEvent(config.Event{
+		EventMeta: *meta,
+		Op:        "stroke-add",
+		Payload:   middleware.EncodeNetworkMsg(s),
+		CreatedAt: time.Now().UnixMilli(),
+		EntityID:  s.ID,
+	})
+}
+
+func persistStrokeRemove(meta *config.EventMeta, m config.NetworkMsg) {
+	db.WriteEvent(config.Event{
+		EventMeta: *meta,
+		Op:        "stroke-remove",
+		Payload:   middleware.EncodeNetworkMsg(m),
+		CreatedAt: time.Now().UnixMilli(),
+		EntityID:  m.ID,
+	})
+}
+
+func persistDomAdd(meta *config.EventMeta, userId string, m config.NetworkMsg) {
+	now := time.Now().UnixMilli()
+
+	db.WriteEvent(config.Event{
+		EventMeta: *meta,
+		Op:        "dom-add",
+		Payload:   middleware.EncodeNetworkMsg(m),
+		CreatedAt: now,
+		EntityID:  m.ID,
+	})
+	db.WriteDom(config.DomEvent{
+		RoomID:    meta.RoomID,
+		UserID:    userId,
+		CreatedAt: now,
+		UpdatedAt: now,
+		DomObjectNetwork: config.DomObjectNetwork{
+			ID:         m.ID,
+			Kind:       m.DomObject.Kind,
+			Transform:  m.DomObject.Transform,
+			Payload:    m.DomObject.Payload,
+			LayerIndex: m.DomObject.LayerIndex,
+		},
+	}, db.OpDomCreate)
+}
+
+func persistDomTransform(meta *config.EventMeta, userId string, m config.NetworkMsg) {
+	db.WriteEvent(config.Event{
+		EventMeta: *meta,
+		Op:        "dom-transform",
+		Payload:   middleware.EncodeNetworkMsg(m),
+		CreatedAt: time.Now().UnixMilli(),
+		EntityID:  m.ID,
+	})
+	db.WriteDom(config.DomEvent{
+		RoomID:    meta.RoomID,
+		UserID:    userId,
+		UpdatedAt: time.Now().UnixMilli(),
+		DomObjectNetwork: config.DomObjectNetwork{
+			ID:        m.ID,
+			Transform: *m.Transform,
+		},
+	}, db.OpDomTransform)
+}
+
+func persistDomRemove(meta *config.EventMeta, m config.NetworkMsg) {
+	db.WriteEvent(config.Event{
+		EventMeta: *meta,
+		Op:        "dom-remove",
+		Payload:   middleware.EncodeNetworkMsg(m),
+		CreatedAt: time.Now().UnixMilli(),
+		EntityID:  m.ID,
+	})
+
+	db.RemoveDom(m.ID, meta.RoomID)
+}
+
+/* --------------------------------------------------
+   UNDO / REDO
+   -------------------------------------------------- */
+
+// handleHistory pops one entry and writes its inverse (undo) or replays it (redo)
+// as a new event so replay stays in sync. The sender gets the result too since
+// it does not know which step the server picked.
+func (c *Client) handleHistory(undo bool) *config.ServerMsg {
+	key := historyKey(c.roomId, c.userId, c.layer.Load())
+
+	e, ok := History.pop(key, undo)
+	if !ok {
+		return nil
+	}
+
+	res, ok := c.applyHistory(e, undo)
+	if !ok {
+		// keep the step so the user can retry once the lock is released
+		History.push(key, e, undo)
+
+		op := "redo-denied"
+		if undo {
+			op = "undo-denied"
+		}
+		c.reply(config.ServerMsg{
+			Clock: 0,
+			Payload: config.NetworkMsg{
+				Operation: op,
+				ID:        e.ID,
+			},
+		})
+		return nil
+	}
+
+	History.push(key, e, !undo)
+	c.reply(*res)
+
+	return res
+}
+
+func (c *Client) applyHistory(e historyEntry, undo bool) (*config.ServerMsg, bool) {
+	meta := &config.EventMeta{
+		RoomID:     c.roomId,
+		UserID:     c.userId,
+		LayerIndex: c.layer.Load(),
+	}
+
+	// an object held by someone else can not be changed under them
+	if e.Op != "stroke-add" {
+		domLocks.Mu.Lock()
+		ownerID, exists := domLocks.buffer[e.ID]
+		domLocks.Mu.Unlock()
+
+		if exists && ownerID != c.userId {
+			return nil, false
+		}
+	}
+
+	switch e.Op {
+
+	case "stroke-add":
+		meta.ID = NextClock(meta.RoomID)
+		if undo {
+			m := config.NetworkMsg{Operation: "stroke-remove", ID: e.ID}
+			persistStrokeRemove(meta, m)
+			return &config.ServerMsg{Clock: meta.ID, Payload: m}, true
+		}
+
+		persistStrokeAdd(meta, e.Stroke)
+		return &config.ServerMsg{
+			Clock: meta.ID,
+			Payload: config.NetworkMsg{
+				Operation: "stroke-add",
+				ID:        e.ID,
+				Stroke:    e.Stroke,
+			},
+		}, true
+
+	case "dom-add", "dom-remove":
+		// undo of add and redo of remove both delete the object
+		remove := (e.Op == "dom-add") == undo
+
+		meta.ID = NextClock(meta.RoomID)
+		if remove {
+			m := config.NetworkMsg{Operation: "dom-remove", ID: e.ID}
+			persistDomRemove(meta, m)
+			domStates.Delete(c.roomId, e.ID)
+			return &config.ServerMsg{Clock: meta.ID, Payload: m}, true
+		}
+
+		dom := e.After
+		if e.Op == "dom-remove" {
+			dom = e.Before
+		}
+		d := *dom
+		m := config.NetworkMsg{Operation: "dom-add", ID: e.ID, DomObject: &d}
+		persistDomAdd(meta, c.userId, m)
+		domStates.Set(c.roomId, d)
+		return &config.ServerMsg{Clock: meta.ID, Payload: m}, true
+
+	case "dom-transform":
+		dom := e.After
+		if undo {
+			dom = e.Before
+		}
+		t := dom.Transform
+
+		meta.ID = NextClock(meta.RoomID)
+		m := config.NetworkMsg{Operation: "dom-transform", ID: e.ID, Transform: &t}
+		persistDomTransform(meta, c.userId, m)
+		domStates.Set(c.roomId, *dom)
+		return &config.ServerMsg{Clock: meta.ID, Payload: m}, true
+	}
+
+	return nil, false
+}
+
+// reply sends msgs only to this client
+func (c *Client) reply(msgs ...config.ServerMsg) {
+	data := middleware.EncodeNetworkMsg(msgs)
+	if data != nil {
+		c.sendJSON(data)
+	}
+}
@@ -5,23 +5,83 @@ import (
 	"fmt"
 	"log"
 	"sync"
-	"sync/atomic"
 	"time"
 
+	"github.com/Tk21111/whiteboard_server/bus"
 	"github.com/Tk21111/whiteboard_server/config"
 	"github.com/Tk21111/whiteboard_server/db"
 	"github.com/Tk21111/whiteboard_server/middleware"
+	"github.com/Tk21111/whiteboard_server/thumb"
 )
 
-type Room struct {
-	clients map[*Client]bool
-	clock   atomic.Int64
+func NextClock(roomId string) int64 {
+	// every clocked op changes the board, the thumbnail catches up later
+	thumb.Touch(roomId)
+
+	room, ok := H.room(roomId)
+
+	if _, isShared := roomBus.(bus.Clocks); isShared {
+		var floor int64
+		if ok {
+			floor = room.floor
+		} else {
+			floor = maxPersistedId(roomId)
+		}
+		if clock, shared := sharedClock(roomId, floor); shared {
+			if ok {
+				// keeps the local clock usable if the bus goes away
+				room.async(func() { room.clock = max(room.clock, clock) })
+			}
+			return clock
+		}
+	}
+
+	if ok {
+		var clock int64
+		if room.do(func() {
+			room.clock++
+			clock = room.clock
+		}) {
+			return clock
+		}
+	}
+
+	// room already closed (late write from a leaving client)
+	fmt.Println("[hub] next clock on closed room", roomId)
+	return maxPersistedId(roomId) + 1
 }
 
-func NextClock(roomId string) int64 {
-	return H.rooms[roomId].clock.Add(1)
+func maxPersistedId(roomId string) int64 {
+	maxId, err := db.GetMaxIdByRoom(roomId)
+	if err != nil {
+		fmt.Println("[db] get max id err")
+	}
+	return maxId
 }
 
+// currentClock is the live room clock, or the persisted one when nobody is
+// connected to the room yet.
+func currentClock(roomId string) int64 {
+	if clocks, shared := roomBus.(bus.Clocks); shared {
+		clock, err := clocks.CurrentClock(roomId)
+		if err == nil {
+			return max(clock, maxPersistedId(roomId))
+		}
+		fmt.Println("[bus] current clock err", roomId, err)
+	}
+
+	if room, ok := H.room(roomId); ok {
+		var clock int64
+		if room.do(func() { clock = room.clock }) {
+			return clock
+		}
+	}
+
+	return maxPersistedId(roomId)
+}
+
+// Hub only guards the room map, everything inside a room runs on the
+// room goroutine (see room.go).
 type Hub struct {
 	rooms map[string]*Room
 	mu    sync.Mutex
@@ -31,29 +91,52 @@ var H = Hub{
 	rooms: make(map[string]*Room),
 }
 
-func (h *Hub) Join(roomID string, c *Client) {
+func (h *Hub) room(roomID string) (*Room, bool) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
+	room, ok := h.rooms[roomID]
+	return room, ok
+}
+
+func (h *Hub) Join(roomID string, c *Client) {
+	h.mu.Lock()
 	room, ok := h.rooms[roomID]
 	if !ok {
+		room = newRoom(roomID, maxPersistedId(roomID))
+		h.rooms[roomID] = room
+	}
 
-		maxId, err := db.GetMaxIdByRoom(roomID)
-		if err != nil {
-			fmt.Println("[db] get max id err")
-		}
-		room = &Room{
-			clients: make(map[*Client]bool),
-		}
-		room.clock.Store(maxId)
+	room.do(func() {
+		room.clients[c] = true
+	})
+	h.mu.Unlock()
 
-		h.rooms[roomID] = room
+	if ok {
+		return
 	}
 
-	room.clients[c] = true
+	// the bus may go over the network, so it is not held under the hub
+	// lock. A room that emptied meanwhile drops the subscription again.
+	unsubscribe := subscribeRoom(room)
+	if unsubscribe == nil {
+		return
+	}
+	kept := false
+	room.do(func() {
+		if !room.closed {
+			room.unsubscribe = unsubscribe
+			kept = true
+		}
+	})
+	if !kept {
+		unsubscribe()
+	}
 }
 
 func (h *Hub) Leave(roomID string, c *Client) {
+	// hold the map lock so a concurrent Join can not pick up a room
+	// that is about to stop
 	h.mu.Lock()
 	room, ok := h.rooms[roomID]
 	if !ok {
@@ -61,14 +144,28 @@ func (h *Hub) Leave(roomID string, c *Client) {
 		return
 	}
 
-	delete(room.clients, c)
-	isEmpty := len(room.clients) == 0
+	var isEmpty bool
+	var unsubscribe func()
+	room.do(func() {
+		delete(room.clients, c)
+		isEmpty = len(room.clients) == 0
+		if isEmpty {
+			room.closed = true
+			unsubscribe = room.unsubscribe
+		}
+	})
 	if isEmpty {
 		delete(h.rooms, roomID)
+		room.stop()
 	}
 	h.mu.Unlock()
 
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+
 	if isEmpty {
+		domStates.Clear(roomID)
 		return
 	}
 
@@ -96,52 +193,44 @@ func (h *Hub) Leave(roomID string, c *Client) {
 		}
 	}
 
-	msgs = append(msgs, config.ServerMsg{
-		Clock: 0,
-		Payload: config.NetworkMsg{
-			Operation: "client-leave",
-			ID:        c.userId,
-		},
-	})
+	if !c.anonymous {
+		msgs = append(msgs, config.ServerMsg{
+			Clock: 0,
+			Payload: config.NetworkMsg{
+				Operation: "client-leave",
+				ID:        c.userId,
+			},
+		})
+	}
 
-	data, err := json.Marshal(msgs)
-	if err == nil {
-		h.Broadcast(roomID, data, nil) // Send to everyone remaining
+	if len(msgs) > 0 {
+		data, err := json.Marshal(msgs)
+		if err == nil {
+			h.Broadcast(roomID, data, nil) // Send to everyone remaining
+		}
 	}
 
 	log.Println("leave room", c.roomId, "user", c.userId)
 }
 
+// Broadcast is queued on the room goroutine, so fan-out keeps the order
+// messages were sent in and never races with Join / Leave. Other instances
+// get it through the bus.
 func (h *Hub) Broadcast(roomID string, msg []byte, except *Client) {
-	h.mu.Lock()
-	room, ok := h.rooms[roomID]
-	h.mu.Unlock()
+	layer := int64(-1)
+	if except != nil {
+		layer = except.layer.Load()
+	}
+	publish(roomID, msg, layer)
 
+	room, ok := h.room(roomID)
 	if !ok {
 		return
 	}
 
-	for c := range room.clients {
-
-		// If except is nil → broadcast to everyone
-		if except == nil {
-			select {
-			case c.send <- msg:
-			default:
-				delete(room.clients, c)
-			}
-			continue
-		}
-
-		// Normal case: exclude sender + same layer only
-		if c != except && c.layer.Load() == except.layer.Load() {
-			select {
-			case c.send <- msg:
-			default:
-				delete(room.clients, c)
-			}
-		}
-	}
+	room.async(func() {
+		room.fanOut(msg, except, layer)
+	})
 }
 
 type bufferStruct struct {
@@ -150,7 +239,10 @@ type bufferStruct struct {
 	TTL    int64
 }
 
-const StrokeTTL = 10 * time.Minute
+const (
+	StrokeTTL            = 10 * time.Minute
+	MaxStrokeRemoveBatch = 1000
+)
 
 type StrokeBufferStruct struct {
 	Buffer map[string]*bufferStruct
@@ -180,6 +272,10 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 		LayerIndex: c.layer.Load(),
 	}
 
+	if !c.allowed(m) {
+		return nil
+	}
+
 	switch m.Operation {
 
 	case "stroke-start":
@@ -229,12 +325,11 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 		// flush buffered stroke
 		// fmt.Printf("%#v\n", b.Stroke)
 
-		db.WriteEvent(config.Event{
-			EventMeta: *b.Meta,
-			Op:        "stroke-add",
-			Payload:   middleware.EncodeNetworkMsg(b.Stroke),
-			CreatedAt: time.Now().UnixMilli(),
-			EntityID:  b.Stroke.ID,
+		persistStrokeAdd(b.Meta, b.Stroke)
+		History.Record(historyKey(c.roomId, c.userId, b.Meta.LayerIndex), historyEntry{
+			Op:     "stroke-add",
+			ID:     b.Stroke.ID,
+			Stroke: b.Stroke,
 		})
 
 		return &config.ServerMsg{
@@ -248,29 +343,44 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 			Payload: m,
 		}
 
+	case "stroke-remove":
+		ids := m.IDs
+		if m.ID != "" {
+			ids = append(ids, m.ID)
+		}
+		if len(ids) == 0 || len(ids) > MaxStrokeRemoveBatch {
+			return nil
+		}
+
+		// one event per stroke so GetEvent can match on entity_id
+		for _, id := range ids {
+			meta.ID = NextClock(meta.RoomID)
+			persistStrokeRemove(meta, config.NetworkMsg{
+				Operation: "stroke-remove",
+				ID:        id,
+			})
+		}
+
+		return &config.ServerMsg{
+			Clock:   meta.ID,
+			Payload: m,
+		}
+
 	case "dom-add":
 
 		meta.ID = NextClock(meta.RoomID)
 		m.DomObject.LayerIndex = c.layer.Load()
-		db.WriteEvent(config.Event{
-			EventMeta: *meta,
-			Op:        "dom-add",
-			Payload:   middleware.EncodeNetworkMsg(m),
-			CreatedAt: time.Now().UnixMilli(),
-			EntityID:  m.ID,
+		persistDomAdd(meta, c.userId, m)
+
+		after := *m.DomObject
+		after.ID = m.ID
+		after.UserId = c.userId
+		domStates.Set(c.roomId, after)
+		History.Record(historyKey(c.roomId, c.userId, meta.LayerIndex), historyEntry{
+			Op:    "dom-add",
+			ID:    m.ID,
+			After: &after,
 		})
-		db.WriteDom(config.DomEvent{
-			RoomID:    c.roomId,
-			UserID:    c.userId,
-			CreatedAt: time.Now().UnixMilli(),
-			UpdatedAt: time.Now().UnixMilli(),
-			DomObjectNetwork: config.DomObjectNetwork{
-				ID:        m.ID,
-				Kind:      m.DomObject.Kind,
-				Transform: m.DomObject.Transform,
-				Payload:   m.DomObject.Payload,
-			},
-		}, 0)
 
 		return &config.ServerMsg{
 			Clock:   meta.ID,
@@ -310,23 +420,22 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 			return &config.ServerMsg{}
 		}
 
+		before, found := domStates.Get(c.roomId, m.ID)
+
 		meta.ID = NextClock(meta.RoomID)
-		db.WriteEvent(config.Event{
-			EventMeta: *meta,
-			Op:        "dom-transform",
-			Payload:   middleware.EncodeNetworkMsg(m),
-			CreatedAt: time.Now().UnixMilli(),
-			EntityID:  m.ID,
-		})
-		db.WriteDom(config.DomEvent{
-			RoomID:    c.roomId,
-			UserID:    c.userId,
-			UpdatedAt: time.Now().UnixMilli(),
-			DomObjectNetwork: config.DomObjectNetwork{
-				ID:        m.ID,
-				Transform: *m.Transform,
-			},
-		}, 1)
+		persistDomTransform(meta, c.userId, m)
+
+		if found {
+			after := before
+			after.Transform = *m.Transform
+			domStates.Set(c.roomId, after)
+			History.Record(historyKey(c.roomId, c.userId, meta.LayerIndex), historyEntry{
+				Op:     "dom-transform",
+				ID:     m.ID,
+				Before: &before,
+				After:  &after,
+			})
+		}
 
 		return &config.ServerMsg{
 			Clock:   meta.ID,
@@ -345,6 +454,11 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 			},
 		}, 2)
 
+		if dom, ok := domStates.Get(c.roomId, m.ID); ok {
+			dom.Payload = *m.Payload
+			domStates.Set(c.roomId, dom)
+		}
+
 		return &config.ServerMsg{
 			Clock:   0,
 			Payload: m,
@@ -352,22 +466,42 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 
 	case "dom-remove":
 
-		meta.ID = NextClock(meta.RoomID)
-		db.WriteEvent(config.Event{
-			EventMeta: *meta,
-			Op:        "dom-remove",
-			Payload:   middleware.EncodeNetworkMsg(m),
-			CreatedAt: time.Now().UnixMilli(),
-			EntityID:  m.ID,
-		})
+		before, found := domStates.Get(c.roomId, m.ID)
 
-		db.RemoveDom(m.ID, c.roomId)
+		meta.ID = NextClock(meta.RoomID)
+		persistDomRemove(meta, m)
+
+		if found {
+			domStates.Delete(c.roomId, m.ID)
+			History.Record(historyKey(c.roomId, c.userId, meta.LayerIndex), historyEntry{
+				Op:     "dom-remove",
+				ID:     m.ID,
+				Before: &before,
+			})
+		}
 
 		return &config.ServerMsg{
 			Clock:   meta.ID,
 			Payload: m,
 		}
 
+	case "resume":
+		if m.Since == nil {
+			return nil
+		}
+		c.sendResume(*m.Since)
+		return nil
+
+	case "history-seek":
+		c.sendSeek(m)
+		return nil
+
+	case "undo":
+		return c.handleHistory(true)
+
+	case "redo":
+		return c.handleHistory(false)
+
 	case "cursor-update":
 		return &config.ServerMsg{
 			Clock:   0,
@@ -400,7 +534,7 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 					},
 				})
 				if deny != nil {
-					c.send <- deny
+					c.sendJSON(deny)
 				}
 				return nil
 			}
@@ -424,8 +558,14 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 			return nil
 		}
 
-		// User doesn't have a private layer, create one
-		newIndex, err := db.CreateLayer(c.roomId, c.userId, c.name, 0)
+		// User doesn't have a private layer, create one. Viewers that have
+		// not joined can not, that would write to the room.
+		newIndex := int64(-1)
+		if config.Role(c.role.Load()) >= config.RoleMember {
+			newIndex, err = db.CreateLayer(c.roomId, c.userId, c.name, 0)
+		} else {
+			err = db.ErrForbidden
+		}
 		if err != nil {
 			log.Println("CreateLayer error:", err)
 			deny := middleware.EncodeNetworkMsg([]config.ServerMsg{
@@ -440,7 +580,7 @@ func (c *Client) handleMsg(m config.NetworkMsg) *config.ServerMsg {
 				},
 			})
 			if deny != nil {
-				c.send <- deny
+				c.sendJSON(deny)
 			}
 			return nil
 		}
@@ -469,34 +609,34 @@ func (c *Client) sendReplay() {
 	})
 	if ack != nil {
 		//check here
-		c.send <- ack
+		c.sendJSON(ack)
 	}
 
 	//send replay
-	replay, err := GetReplay(c.userId, c.roomId, c.layer.Load(), "0")
+	replay, err := GetReplay(c.userId, c.roomId, c.layer.Load(), "0", 0)
 	if err != nil {
 		fmt.Println("fail to get replay")
 		return
 	}
 	data := middleware.EncodeNetworkMsg(replay)
 	if data != nil {
-		c.send <- data
+		c.sendJSON(data)
 	}
 }
 
 func (h *Hub) GetClients(roomId string) []*Client {
-	h.mu.Lock()
-	defer h.mu.Unlock()
-
-	room, ok := h.rooms[roomId]
+	room, ok := h.room(roomId)
 	if !ok {
 		return nil
 	}
 
-	clients := make([]*Client, 0, len(room.clients))
-	for c := range room.clients {
-		clients = append(clients, c)
-	}
+	var clients []*Client
+	room.do(func() {
+		clients = make([]*Client, 0, len(room.clients))
+		for c := range room.clients {
+			clients = append(clients, c)
+		}
+	})
 
 	return clients
 }
@@ -516,6 +656,8 @@ func StartStrokeTTLGC() {
 				}
 			}
 			StrokeBuffer.Mu.Unlock()
+
+			History.gc(now)
 		}
 	}()
 }
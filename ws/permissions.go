@@ -0,0 +1,108 @@
+package ws
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+// PermissionsTTL is how long a room matrix is cached. Changes made on this
+// instance apply at once, other instances behind the bus pick them up after
+// at most this long.
+var PermissionsTTL = 30 * time.Second
+
+type cachedPermissions struct {
+	perms config.Permissions
+	at    time.Time
+}
+
+var permissions = struct {
+	mu    sync.Mutex
+	rooms map[string]cachedPermissions
+}{
+	rooms: make(map[string]cachedPermissions),
+}
+
+// RoomPermissions is config.DefaultPermissions with the room overrides on
+// top. When the overrides can not be read the defaults apply.
+func RoomPermissions(roomID string) config.Permissions {
+	permissions.mu.Lock()
+	cached, ok := permissions.rooms[roomID]
+	permissions.mu.Unlock()
+	if ok && time.Since(cached.at) < PermissionsTTL {
+		return cached.perms
+	}
+
+	overrides, err := db.GetRoomPermissions(roomID)
+	if err != nil {
+		fmt.Println("[ws] permissions load failed", roomID, err)
+		return config.DefaultPermissions
+	}
+	perms := config.DefaultPermissions.With(overrides)
+
+	permissions.mu.Lock()
+	permissions.rooms[roomID] = cachedPermissions{perms: perms, at: time.Now()}
+	permissions.mu.Unlock()
+
+	return perms
+}
+
+// InvalidatePermissions drops the cached matrix after the overrides changed
+func InvalidatePermissions(roomID string) {
+	permissions.mu.Lock()
+	delete(permissions.rooms, roomID)
+	permissions.mu.Unlock()
+}
+
+// allowed checks op against the room matrix and tells the client when it
+// is not, the reply is the op with -denied appended. Anonymous viewers are
+// limited to config.ViewerOperations, their denials carry no role since no
+// role would do without an account.
+func (c *Client) allowed(m config.NetworkMsg) bool {
+	deny := config.NetworkMsg{
+		Operation: m.Operation + "-denied",
+		ID:        m.ID,
+		IDs:       m.IDs,
+	}
+
+	if c.anonymous {
+		if slices.Contains(config.ViewerOperations, m.Operation) {
+			return true
+		}
+		c.reply(config.ServerMsg{Clock: 0, Payload: deny})
+		return false
+	}
+
+	required := RoomPermissions(c.roomId).Required(m.Operation)
+	if config.Role(c.role.Load()) >= required {
+		return true
+	}
+
+	deny.Role = &required
+	c.reply(config.ServerMsg{Clock: 0, Payload: deny})
+	return false
+}
+
+// SetRole updates the role of a user's open sockets in a room, after a join
+// or when the owner changes it
+func SetRole(roomID, userID string, role config.Role) {
+	for _, c := range H.GetClients(roomID) {
+		if c.userId == userID && !c.anonymous {
+			c.role.Store(int64(role))
+		}
+	}
+}
+
+// DropAnonymous disconnects the anonymous viewers of a room after the owner
+// turned them off, the flag is only checked when a socket opens
+func DropAnonymous(roomID string) {
+	for _, c := range H.GetClients(roomID) {
+		if c.anonymous {
+			c.close()
+		}
+	}
+}
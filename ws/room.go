@@ -0,0 +1,166 @@
+package ws
+
+import (
+	"encoding/json"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/middleware"
+)
+
+const roomQueueSize = 1024
+
+// Room is owned by its run goroutine: clients and clock are only touched
+// from funcs passed through cmds, so joins, leaves, clock assignment and
+// fan-out are serialised without a lock.
+type Room struct {
+	id      string
+	clients map[*Client]bool
+	clock   int64
+	// persisted clock when the room opened, the floor for shared clocks
+	floor int64
+
+	// set once the bus subscription is up, closed once the last client
+	// left and the subscription must not be kept
+	unsubscribe func()
+	closed      bool
+
+	cmds chan func()
+	done chan struct{}
+}
+
+func newRoom(id string, clock int64) *Room {
+	r := &Room{
+		id:      id,
+		clients: make(map[*Client]bool),
+		clock:   clock,
+		floor:   clock,
+		cmds:    make(chan func(), roomQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go r.run()
+	return r
+}
+
+func (r *Room) run() {
+	defer close(r.done)
+
+	for fn := range r.cmds {
+		if fn == nil {
+			return // stop
+		}
+		fn()
+	}
+}
+
+// do runs fn on the room goroutine and waits for it.
+// Returns false if the room stopped before fn ran.
+func (r *Room) do(fn func()) bool {
+	finished := make(chan struct{})
+
+	select {
+	case r.cmds <- func() {
+		fn()
+		close(finished)
+	}:
+	case <-r.done:
+		return false
+	}
+
+	select {
+	case <-finished:
+		return true
+	case <-r.done:
+		// stop was queued ahead of fn
+		select {
+		case <-finished:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// async queues fn without waiting, a full queue blocks the caller.
+func (r *Room) async(fn func()) {
+	select {
+	case r.cmds <- fn:
+	case <-r.done:
+	}
+}
+
+// tryAsync queues fn unless the queue is full, for callers that must not
+// block such as the bus reader. false when fn was dropped.
+func (r *Room) tryAsync(fn func()) bool {
+	select {
+	case r.cmds <- fn:
+		return true
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop is called by Hub.Leave under the hub lock once the room is empty,
+// anything queued before it still runs.
+func (r *Room) stop() {
+	r.async(nil)
+}
+
+// fanOut runs on the room goroutine. layer < 0 sends to every layer.
+func (r *Room) fanOut(msg []byte, except *Client, layer int64) {
+	// every socket of the same wire format shares one prepared frame,
+	// so compression and framing happen once per broadcast
+	var text, bin *outFrame
+	frame := func(c *Client) *outFrame {
+		if !c.binary {
+			if text == nil {
+				f, err := newFrame(msg, false)
+				if err != nil {
+					return nil
+				}
+				text = &f
+			}
+			return text
+		}
+		if bin == nil {
+			b, err := middleware.JSONToBinary(msg)
+			if err != nil {
+				return nil
+			}
+			f, err := newFrame(b, true)
+			if err != nil {
+				return nil
+			}
+			bin = &f
+		}
+		return bin
+	}
+
+	// only decoded when some client is behind and may coalesce it
+	var decoded []config.ServerMsg
+	var decodedOnce bool
+	batch := func() []config.ServerMsg {
+		if !decodedOnce {
+			decodedOnce = true
+			_ = json.Unmarshal(msg, &decoded)
+		}
+		return decoded
+	}
+
+	for c := range r.clients {
+
+		// layer < 0 → broadcast to everyone
+		// Normal case: exclude sender + same layer only
+		if c == except || (layer >= 0 && c.layer.Load() != layer) {
+			continue
+		}
+
+		f := frame(c)
+		if f == nil {
+			continue
+		}
+		c.enqueue(*f, batch)
+	}
+}
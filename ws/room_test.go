@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+// run with -race, these only prove something under the race detector
+
+// testClient has no socket, what the room sends it is counted from send
+type testClient struct {
+	*Client
+	frames chan int // sizes
+	stop   chan struct{}
+}
+
+func newTestClient(roomID, userID string) *testClient {
+	c := &testClient{
+		Client: &Client{
+			send:   make(chan outFrame, 4096), // never behind, see backpressure.go
+			done:   make(chan struct{}),
+			roomId: roomID,
+			userId: userID,
+		},
+		frames: make(chan int, 4096),
+		stop:   make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			select {
+			case f := <-c.send:
+				select {
+				case c.frames <- f.size:
+				default:
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func TestRoomConcurrentJoinLeaveClock(t *testing.T) {
+	db.OpenTestStore(t)
+
+	const (
+		roomID  = "race-room"
+		users   = 16
+		clocks  = 50
+		rejoins = 5
+	)
+
+	msg := []byte(`[{"clock":0,"payload":{"operation":"cursor-update"}}]`)
+
+	// keeps the room open so clocks never restart from the db
+	anchor := newTestClient(roomID, "anchor")
+	defer close(anchor.stop)
+	H.Join(roomID, anchor.Client)
+
+	var mu sync.Mutex
+	var got []int64
+
+	var wg sync.WaitGroup
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(u int) {
+			defer wg.Done()
+
+			var mine []int64
+			for j := 0; j < rejoins; j++ {
+				c := newTestClient(roomID, fmt.Sprintf("user-%d-%d", u, j))
+				H.Join(roomID, c.Client)
+
+				for k := 0; k < clocks/rejoins; k++ {
+					mine = append(mine, NextClock(roomID))
+					H.Broadcast(roomID, msg, c.Client)
+					H.Broadcast(roomID, msg, nil)
+				}
+				_ = currentClock(roomID)
+
+				H.Leave(roomID, c.Client)
+				close(c.stop)
+			}
+
+			for i := 1; i < len(mine); i++ {
+				if mine[i] <= mine[i-1] {
+					t.Errorf("user %d clock went from %d to %d", u, mine[i-1], mine[i])
+				}
+			}
+
+			mu.Lock()
+			got = append(got, mine...)
+			mu.Unlock()
+		}(u)
+	}
+	wg.Wait()
+
+	// every clock handed out once, with no gaps
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	for i, clock := range got {
+		if clock != int64(i+1) {
+			t.Fatalf("clock %d at %d, want %d", clock, i, i+1)
+		}
+	}
+	if n := len(H.GetClients(roomID)); n != 1 {
+		t.Fatalf("%d clients left, want the anchor only", n)
+	}
+
+	H.Leave(roomID, anchor.Client)
+	if _, ok := H.room(roomID); ok {
+		t.Fatal("empty room was not stopped")
+	}
+}
+
+func TestRoomBroadcastFanOut(t *testing.T) {
+	db.OpenTestStore(t)
+
+	const (
+		roomID  = "race-fanout"
+		senders = 8
+		each    = 100
+	)
+
+	msg := []byte(`[{"clock":0,"payload":{"operation":"ping"}}]`)
+
+	listener := newTestClient(roomID, "listener")
+	defer close(listener.stop)
+	H.Join(roomID, listener.Client)
+	defer H.Leave(roomID, listener.Client)
+
+	var wg sync.WaitGroup
+	for s := 0; s < senders; s++ {
+		wg.Add(1)
+		go func(s int) {
+			defer wg.Done()
+
+			// sockets coming and going must not lose or duplicate broadcasts
+			c := newTestClient(roomID, fmt.Sprintf("sender-%d", s))
+			H.Join(roomID, c.Client)
+			for i := 0; i < each; i++ {
+				H.Broadcast(roomID, msg, nil)
+			}
+			H.Leave(roomID, c.Client)
+			close(c.stop)
+		}(s)
+	}
+	wg.Wait()
+
+	want := senders * each
+	received := 0
+	timeout := time.After(5 * time.Second)
+	for received < want {
+		select {
+		case size := <-listener.frames:
+			if size == len(msg) {
+				received++
+			}
+		case <-timeout:
+			t.Fatalf("listener got %d of %d broadcasts", received, want)
+		}
+	}
+
+	// and nothing extra once the queue is drained
+	room, _ := H.room(roomID)
+	room.do(func() {})
+	select {
+	case size := <-listener.frames:
+		if size == len(msg) {
+			t.Fatal("listener got more broadcasts than were sent")
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,210 @@
+package ws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/Tk21111/whiteboard_server/config"
+	"github.com/Tk21111/whiteboard_server/db"
+)
+
+// historyReplay is the diff that takes a client showing clock from to the
+// board at clock to, from 0 meaning an empty board. Both clocks are rebuilt
+// from the log, so seeking backwards works the same as forwards.
+func historyReplay(roomID string, layer int64, from int64, to int64) ([]config.ServerMsg, error) {
+	strokes, doms, err := db.GetLayerStateAt(roomID, layer, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseStrokes []config.Event
+	var baseDoms []config.DomObjectNetwork
+	if from > 0 {
+		baseStrokes, baseDoms, err = db.GetLayerStateAt(roomID, layer, from)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	replay := make([]config.ServerMsg, 0)
+
+	live := make(map[string]bool, len(strokes))
+	for _, e := range strokes {
+		live[e.EntityID] = true
+	}
+	shown := make(map[string]bool, len(baseStrokes))
+	for _, e := range baseStrokes {
+		shown[e.EntityID] = true
+		if !live[e.EntityID] {
+			replay = append(replay, config.ServerMsg{
+				Clock: 0,
+				Payload: config.NetworkMsg{
+					ID:        e.EntityID,
+					Operation: "stroke-remove",
+				},
+			})
+		}
+	}
+
+	for _, e := range strokes {
+		if shown[e.EntityID] {
+			continue
+		}
+
+		var decoded config.StrokeObjectInterface
+		if err := json.Unmarshal(e.Payload, &decoded); err != nil {
+			continue
+		}
+
+		replay = append(replay, config.ServerMsg{
+			Clock: e.ID,
+			Payload: config.NetworkMsg{
+				ID:        strconv.FormatInt(e.ID, 10),
+				Operation: "stroke-add",
+				Stroke:    &decoded,
+			},
+		})
+	}
+
+	before := make(map[string]config.DomObjectNetwork, len(baseDoms))
+	for _, d := range baseDoms {
+		before[d.ID] = d
+	}
+	after := make(map[string]bool, len(doms))
+	for _, d := range doms {
+		after[d.ID] = true
+	}
+
+	for _, d := range baseDoms {
+		if !after[d.ID] {
+			replay = append(replay, config.ServerMsg{
+				Clock: 0,
+				Payload: config.NetworkMsg{
+					ID:        d.ID,
+					Operation: "dom-remove",
+				},
+			})
+		}
+	}
+
+	for _, d := range doms {
+		old, ok := before[d.ID]
+		switch {
+		case !ok || old.Payload != d.Payload || old.Kind != d.Kind:
+			replay = append(replay, config.ServerMsg{
+				Clock: 0,
+				Payload: config.NetworkMsg{
+					ID:        d.ID,
+					Operation: "dom-add",
+					DomObject: &d,
+				},
+			})
+		case old.Transform != d.Transform:
+			replay = append(replay, config.ServerMsg{
+				Clock: 0,
+				Payload: config.NetworkMsg{
+					ID:        d.ID,
+					Operation: "dom-transform",
+					Transform: &d.Transform,
+				},
+			})
+		}
+	}
+
+	return replay, nil
+}
+
+// SeekClock resolves a history-seek target, at (unix ms) wins over to.
+// 0 means the live board.
+func SeekClock(roomID string, to *int64, at *int64) (int64, error) {
+	if at != nil {
+		return db.GetClockAt(roomID, *at)
+	}
+	if to != nil && *to > 0 {
+		return *to, nil
+	}
+	return 0, nil
+}
+
+// sendSeek answers history-seek with the board at the requested clock. since
+// is the history clock the client shows, it gets a diff against it when the
+// log still covers it and the full state with resync set otherwise. A seek
+// without a target goes back to the live board through a resume.
+func (c *Client) sendSeek(m config.NetworkMsg) {
+	layer := c.layer.Load()
+
+	clock, err := SeekClock(c.roomId, m.To, m.At)
+	if err != nil {
+		fmt.Println("fail to resolve history-seek", err)
+		c.denySeek(m)
+		return
+	}
+	if clock <= 0 {
+		if m.At != nil {
+			// nothing was drawn yet at that time
+			c.reply(config.ServerMsg{
+				Clock: 0,
+				Payload: config.NetworkMsg{
+					Operation: "history-seek",
+					To:        &clock,
+					At:        m.At,
+					Resync:    true,
+				},
+			})
+			return
+		}
+		c.sendResume(0)
+		return
+	}
+
+	var since int64
+	if m.Since != nil {
+		since = *m.Since
+	}
+
+	resync := since <= 0
+	if !resync {
+		compacted, err := db.GetCompactedClock(c.roomId, layer)
+		if err != nil || since < compacted {
+			resync = true
+		}
+	}
+	if resync {
+		since = 0
+	}
+
+	replay, err := GetReplay(c.userId, c.roomId, layer, strconv.FormatInt(since, 10), clock)
+	if err != nil {
+		if !errors.Is(err, db.ErrCompacted) {
+			fmt.Println("fail to get history replay", err)
+		}
+		c.denySeek(m)
+		return
+	}
+
+	marker := config.ServerMsg{
+		Clock: clock,
+		Payload: config.NetworkMsg{
+			Operation: "history-seek",
+			Since:     &since,
+			To:        &clock,
+			At:        m.At,
+			Resync:    resync,
+		},
+	}
+
+	c.reply(append([]config.ServerMsg{marker}, replay...)...)
+}
+
+func (c *Client) denySeek(m config.NetworkMsg) {
+	c.reply(config.ServerMsg{
+		Clock: 0,
+		Payload: config.NetworkMsg{
+			Operation: "history-seek-denied",
+			To:        m.To,
+			At:        m.At,
+		},
+	})
+}
@@ -0,0 +1,85 @@
+package ws
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+type WireStats struct {
+	Messages     atomic.Int64 // frames queued to sockets
+	Prepared     atomic.Int64 // frames compressed + framed (once per broadcast)
+	PayloadBytes atomic.Int64 // bytes before framing / compression, per socket
+	WireBytes    atomic.Int64 // bytes actually written to sockets
+}
+
+var Stats WireStats
+
+func (s *WireStats) Snapshot() map[string]int64 {
+	payload := s.PayloadBytes.Load()
+	wire := s.WireBytes.Load()
+
+	return map[string]int64{
+		"messages":     s.Messages.Load(),
+		"prepared":     s.Prepared.Load(),
+		"payloadBytes": payload,
+		"wireBytes":    wire,
+		"bytesSaved":   payload - wire,
+	}
+}
+
+// outFrame is what sits in Client.send, framed once and shared by every
+// socket of a broadcast.
+type outFrame struct {
+	msg  *websocket.PreparedMessage
+	size int
+}
+
+func newFrame(data []byte, binary bool) (outFrame, error) {
+	msgType := websocket.TextMessage
+	if binary {
+		msgType = websocket.BinaryMessage
+	}
+
+	pm, err := websocket.NewPreparedMessage(msgType, data)
+	if err != nil {
+		return outFrame{}, err
+	}
+
+	Stats.Prepared.Add(1)
+	return outFrame{msg: pm, size: len(data)}, nil
+}
+
+// countingWriter hands gorilla a conn that counts what goes on the wire,
+// after permessage-deflate.
+type countingWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return countingConn{Conn: conn}, brw, nil
+}
+
+type countingConn struct {
+	net.Conn
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	Stats.WireBytes.Add(int64(n))
+	return n, err
+}